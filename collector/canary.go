@@ -0,0 +1,331 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CanaryConfig configures the canary, which publishes messages to every
+// nsqd node over the TCP protocol and consumes them again.
+type CanaryConfig struct {
+	// Interval between two canary rounds.
+	Interval time.Duration
+	// Timeout of a canary round of a single node.
+	Timeout time.Duration
+	// Topic and Channel the canary messages are published to and
+	// consumed from. Ephemeral names keep nsqd from persisting them.
+	Topic   string
+	Channel string
+}
+
+// see https://nsq.io/clients/tcp_protocol_spec.html
+const (
+	frameTypeResponse = 0
+	frameTypeError    = 1
+	frameTypeMessage  = 2
+
+	// message header: timestamp (8 bytes), attempts (2 bytes), id (16 bytes)
+	messageHeaderSize = 26
+	maxFrameSize      = 16 * 1024 * 1024
+)
+
+var (
+	protocolMagic     = []byte("  V2")
+	responseOK        = []byte("OK")
+	responseHeartbeat = []byte("_heartbeat_")
+)
+
+// nsqdConn is a connection to the TCP interface of nsqd.
+type nsqdConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialNsqd connects to the TCP interface of nsqd and identifies itself.
+// The connection is closed once ctx is done.
+func dialNsqd(ctx context.Context, addr string) (*nsqdConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	c := &nsqdConn{Conn: conn, r: bufio.NewReader(conn)}
+	if _, err = c.Write(protocolMagic); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	identify, err := json.Marshal(map[string]interface{}{
+		"client_id":           "nsq_exporter",
+		"hostname":            hostname,
+		"user_agent":          "nsq_exporter",
+		"feature_negotiation": false,
+	})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err = c.command("IDENTIFY", identify); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err = c.readResponse(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("IDENTIFY failed: %v", err)
+	}
+	return c, nil
+}
+
+// command sends a command with the given parameters. The body is only
+// sent if it is not nil.
+func (c *nsqdConn) command(name string, body []byte, params ...string) error {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	for _, p := range params {
+		buf.WriteByte(' ')
+		buf.WriteString(p)
+	}
+	buf.WriteByte('\n')
+	if body != nil {
+		binary.Write(&buf, binary.BigEndian, int32(len(body)))
+		buf.Write(body)
+	}
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// readFrame reads the next frame, answering heartbeats on the way.
+func (c *nsqdConn) readFrame() (int32, []byte, error) {
+	for {
+		var size, frameType int32
+		if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+			return 0, nil, err
+		}
+		if size < 4 || size > maxFrameSize {
+			return 0, nil, fmt.Errorf("invalid frame size %d", size)
+		}
+		if err := binary.Read(c.r, binary.BigEndian, &frameType); err != nil {
+			return 0, nil, err
+		}
+		data := make([]byte, size-4)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return 0, nil, err
+		}
+
+		switch {
+		case frameType == frameTypeResponse && bytes.Equal(data, responseHeartbeat):
+			if err := c.command("NOP", nil); err != nil {
+				return 0, nil, err
+			}
+		case frameType == frameTypeError:
+			return 0, nil, errors.New(string(data))
+		default:
+			return frameType, data, nil
+		}
+	}
+}
+
+// readResponse reads the response to the previous command, which has to
+// be OK.
+func (c *nsqdConn) readResponse() error {
+	frameType, data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if frameType != frameTypeResponse || !bytes.Equal(data, responseOK) {
+		return fmt.Errorf("unexpected response %q", data)
+	}
+	return nil
+}
+
+// readMessage reads the next message and returns its id and body.
+func (c *nsqdConn) readMessage() (string, []byte, error) {
+	for {
+		frameType, data, err := c.readFrame()
+		if err != nil {
+			return "", nil, err
+		}
+		if frameType != frameTypeMessage {
+			continue
+		}
+		if len(data) < messageHeaderSize {
+			return "", nil, fmt.Errorf("invalid message of %d bytes", len(data))
+		}
+		return string(data[10:messageHeaderSize]), data[messageHeaderSize:], nil
+	}
+}
+
+// canaryResult is the result of a canary round of a single node.
+type canaryResult struct {
+	published bool
+	consumed  bool
+	roundTrip time.Duration
+}
+
+// runCanary publishes a message to the nsqd node at addr and waits until
+// the message is consumed from the canary channel. Messages of former
+// rounds are finished and skipped.
+func runCanary(ctx context.Context, addr string, cfg CanaryConfig) (canaryResult, error) {
+	var r canaryResult
+
+	// subscribe first, so the channel exists when the message is published
+	sub, err := dialNsqd(ctx, addr)
+	if err != nil {
+		return r, err
+	}
+	defer sub.Close()
+	if err = sub.command("SUB", nil, cfg.Topic, cfg.Channel); err != nil {
+		return r, err
+	}
+	if err = sub.readResponse(); err != nil {
+		return r, fmt.Errorf("SUB failed: %v", err)
+	}
+	if err = sub.command("RDY", nil, "1"); err != nil {
+		return r, err
+	}
+
+	pub, err := dialNsqd(ctx, addr)
+	if err != nil {
+		return r, err
+	}
+	defer pub.Close()
+
+	start := time.Now()
+	body := []byte(strconv.FormatInt(start.UnixNano(), 10))
+	if err = pub.command("PUB", body, cfg.Topic); err != nil {
+		return r, err
+	}
+	if err = pub.readResponse(); err != nil {
+		return r, fmt.Errorf("PUB failed: %v", err)
+	}
+	r.published = true
+
+	for {
+		id, msg, err := sub.readMessage()
+		if err != nil {
+			return r, err
+		}
+		if err = sub.command("FIN", nil, id); err != nil {
+			return r, err
+		}
+		if bytes.Equal(msg, body) {
+			r.consumed = true
+			r.roundTrip = time.Since(start)
+			return r, nil
+		}
+	}
+}
+
+// StartCanary makes the executor run the canary against all nsqd nodes in
+// the configured interval in the background. The TCP address of nodes
+// which have not been discovered through nsqlookupd is taken from the info
+// endpoint of nsqd. The canary does not support TLS or authentication.
+func (e *NsqExecutor) StartCanary(cfg CanaryConfig) {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	if e.canaryStop != nil {
+		return
+	}
+	e.canaryStop = make(chan struct{})
+
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		var last map[string]bool
+		for {
+			last = e.canaryRound(stop, cfg, last)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(e.canaryStop)
+}
+
+// canaryRound runs the canary against all nodes in parallel and returns
+// the names of the nodes. The metrics of the nodes of the last round which
+// are gone are deleted.
+func (e *NsqExecutor) canaryRound(stop <-chan struct{}, cfg CanaryConfig, last map[string]bool) map[string]bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	names := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, n := range e.nodes(e.discover(ctx)) {
+		names[nodeName(n.url)] = true
+		wg.Add(1)
+		go func(n node) {
+			defer wg.Done()
+			e.canaryNode(ctx, n, cfg)
+		}(n)
+	}
+	wg.Wait()
+
+	for name := range last {
+		if !names[name] {
+			e.canaryPublished.DeleteLabelValues(name)
+			e.canaryConsumed.DeleteLabelValues(name)
+			e.canaryRoundTrip.DeleteLabelValues(name)
+		}
+	}
+	return names
+}
+
+func (e *NsqExecutor) canaryNode(ctx context.Context, n node, cfg CanaryConfig) {
+	ctx, cancel := withTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	name := nodeName(n.url)
+	r, err := e.runCanary(ctx, n, cfg)
+	if err != nil {
+		log.Printf("error running canary against nsqd %s: %v", name, err)
+	}
+	e.canaryPublished.WithLabelValues(name).Set(boolToFloat(r.published))
+	e.canaryConsumed.WithLabelValues(name).Set(boolToFloat(r.consumed))
+	if r.consumed {
+		e.canaryRoundTrip.WithLabelValues(name).Observe(r.roundTrip.Seconds())
+	}
+}
+
+func (e *NsqExecutor) runCanary(ctx context.Context, n node, cfg CanaryConfig) (canaryResult, error) {
+	addr := n.tcpAddr
+	if addr == "" {
+		info, err := getNsqdInfo(ctx, n.client, n.url)
+		if err != nil {
+			return canaryResult{}, err
+		}
+		u, err := url.Parse(n.url)
+		if err != nil {
+			return canaryResult{}, err
+		}
+		addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(info.TCPPort))
+	}
+	return runCanary(ctx, addr, cfg)
+}
@@ -0,0 +1,262 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNsqd implements the parts of the nsqd TCP protocol used by the
+// canary. Subscribers receive a heartbeat and a stale message before the
+// published message.
+type fakeNsqd struct {
+	ln        net.Listener
+	published chan []byte
+	errs      chan error
+}
+
+func newFakeNsqd(t *testing.T) *fakeNsqd {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNsqd{ln: ln, published: make(chan []byte, 1), errs: make(chan error, 2)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := f.serve(conn); err != nil && err != io.EOF {
+					f.errs <- err
+				}
+			}()
+		}
+	}()
+	return f
+}
+
+func (f *fakeNsqd) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	magic := make([]byte, len(protocolMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, protocolMagic) {
+		return fmt.Errorf("unexpected magic %q", magic)
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		params := strings.Fields(line)
+		switch params[0] {
+		case "IDENTIFY":
+			if _, err = readBody(r); err != nil {
+				return err
+			}
+			writeFrame(conn, frameTypeResponse, responseOK)
+		case "SUB":
+			writeFrame(conn, frameTypeResponse, responseOK)
+		case "PUB":
+			body, err := readBody(r)
+			if err != nil {
+				return err
+			}
+			f.published <- body
+			writeFrame(conn, frameTypeResponse, responseOK)
+		case "RDY":
+			return f.deliver(conn, r)
+		default:
+			return fmt.Errorf("unexpected command %q", line)
+		}
+	}
+}
+
+// deliver sends a heartbeat, a stale message and the published message to
+// a subscriber and expects the matching responses.
+func (f *fakeNsqd) deliver(conn net.Conn, r *bufio.Reader) error {
+	writeFrame(conn, frameTypeResponse, responseHeartbeat)
+	if err := expectLine(r, "NOP\n"); err != nil {
+		return err
+	}
+	writeFrame(conn, frameTypeMessage, message("0000000000000001", []byte("stale")))
+	if err := expectLine(r, "FIN 0000000000000001\n"); err != nil {
+		return err
+	}
+	writeFrame(conn, frameTypeMessage, message("0000000000000002", <-f.published))
+	if err := expectLine(r, "FIN 0000000000000002\n"); err != nil {
+		return err
+	}
+	_, err := r.ReadByte()
+	return err
+}
+
+func (f *fakeNsqd) close() error {
+	f.ln.Close()
+	select {
+	case err := <-f.errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func readBody(r io.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	body := make([]byte, size)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func writeFrame(w io.Writer, frameType int32, data []byte) {
+	binary.Write(w, binary.BigEndian, int32(len(data)+4))
+	binary.Write(w, binary.BigEndian, frameType)
+	w.Write(data)
+}
+
+func message(id string, body []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, time.Now().UnixNano())
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	buf.WriteString(id)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func expectLine(r *bufio.Reader, want string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != want {
+		return fmt.Errorf("expected %q, got %q", want, line)
+	}
+	return nil
+}
+
+func TestRunCanary(t *testing.T) {
+	f := newFakeNsqd(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := runCanary(ctx, f.ln.Addr().String(), CanaryConfig{Topic: "canary", Channel: "canary"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !r.published || !r.consumed {
+		t.Errorf("expected published and consumed message, got %+v", r)
+	}
+	if r.roundTrip <= 0 {
+		t.Errorf("expected positive round trip, got %v", r.roundTrip)
+	}
+	if err = f.close(); err != nil {
+		t.Errorf("fake nsqd: %v", err)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		frames    func(w io.Writer)
+		frameType int32
+		data      string
+		err       string
+	}{
+		{
+			name: "heartbeat",
+			frames: func(w io.Writer) {
+				writeFrame(w, frameTypeResponse, responseHeartbeat)
+				writeFrame(w, frameTypeResponse, responseOK)
+			},
+			frameType: frameTypeResponse,
+			data:      "OK",
+		},
+		{
+			name: "error",
+			frames: func(w io.Writer) {
+				writeFrame(w, frameTypeError, []byte("E_BAD_TOPIC"))
+			},
+			err: "E_BAD_TOPIC",
+		},
+		{
+			name: "invalid size",
+			frames: func(w io.Writer) {
+				binary.Write(w, binary.BigEndian, int32(2))
+			},
+			err: "invalid frame size 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in bytes.Buffer
+			tt.frames(&in)
+			var out bytes.Buffer
+			c := &nsqdConn{Conn: &bufferConn{Writer: &out}, r: bufio.NewReader(&in)}
+
+			frameType, data, err := c.readFrame()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if frameType != tt.frameType || string(data) != tt.data {
+				t.Errorf("expected frame %d %q, got %d %q", tt.frameType, tt.data, frameType, data)
+			}
+			if tt.name == "heartbeat" && out.String() != "NOP\n" {
+				t.Errorf("expected NOP after heartbeat, got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var in bytes.Buffer
+	writeFrame(&in, frameTypeResponse, responseOK)
+	writeFrame(&in, frameTypeMessage, message("0123456789abcdef", []byte("body")))
+	c := &nsqdConn{r: bufio.NewReader(&in)}
+
+	id, body, err := c.readMessage()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "0123456789abcdef" || string(body) != "body" {
+		t.Errorf("expected message 0123456789abcdef %q, got %s %q", "body", id, body)
+	}
+
+	var short bytes.Buffer
+	writeFrame(&short, frameTypeMessage, []byte("short"))
+	c = &nsqdConn{r: bufio.NewReader(&short)}
+	if _, _, err = c.readMessage(); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+// bufferConn is a net.Conn writing to a buffer.
+type bufferConn struct {
+	net.Conn
+	io.Writer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.Writer.Write(p)
+}
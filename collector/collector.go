@@ -1,12 +1,156 @@
 package collector
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 // StatsCollector defines an interface for collecting specific stats
-// from a nsqd exported stats data.
+// from a nsqd exported stats data. Custom collectors can be added to an
+// executor by NsqExecutor.Use.
+//
+// On every scrape the executor calls Reset, then Set with the stats of
+// every scraped nsqd node together with the name of the node, and finally
+// Collect. These calls are never concurrent. The stats must not be
+// modified, as they are passed again while polling.
 type StatsCollector interface {
-	set(s *stats)
-	collect(out chan<- prometheus.Metric)
-	describe(ch chan<- *prometheus.Desc)
-	reset()
+	// Set exports the stats of a nsqd node.
+	Set(node string, s *Stats)
+	// Collect sends the metrics exported since the last reset.
+	Collect(out chan<- prometheus.Metric)
+	// Describe sends the descriptors of all metrics.
+	Describe(ch chan<- *prometheus.Desc)
+	// Reset drops the metrics exported by the previous scrape.
+	Reset()
+}
+
+// MemoryCollector is an optional interface of stats collectors which
+// need the memory stats of nsqd, see Stats.Memory.
+type MemoryCollector interface {
+	NeedsMemory() bool
+}
+
+// InfoCollector is an optional interface of stats collectors which need
+// the node info of nsqd, see Stats.Info.
+type InfoCollector interface {
+	NeedsInfo() bool
+}
+
+// nodeKeeper is implemented by collectors which keep state of the nsqd
+// nodes across scrapes. keep is called instead of Set for nodes which
+// could not be scraped, so their state is only dropped once the nodes are
+// gone.
+type nodeKeeper interface {
+	keep(node string)
+}
+
+// LookupdCollector defines an interface for collecting specific stats
+// of nsqlookupd. Custom collectors can be added to an executor by
+// NsqExecutor.UseLookupd. The methods are called like the ones of
+// StatsCollector, Set with the stats of every nsqlookupd instance
+// together with the name of the instance.
+type LookupdCollector interface {
+	// Set exports the stats of a nsqlookupd instance.
+	Set(lookupd string, s *LookupdStats)
+	// Collect sends the metrics exported since the last reset.
+	Collect(out chan<- prometheus.Metric)
+	// Describe sends the descriptors of all metrics.
+	Describe(ch chan<- *prometheus.Desc)
+	// Reset drops the metrics exported by the previous scrape.
+	Reset()
+}
+
+// Options configures the stats collectors.
+type Options struct {
+	// Namespace is the namespace of all exported metrics.
+	Namespace string
+
+	// LegacyCounters additionally exports the totals reported by nsqd
+	// as gauges with their former *_count names.
+	LegacyCounters bool
+
+	// PausedLabel additionally labels the topic and channel metrics with
+	// the pause state, as done by former versions. Pausing then starts
+	// new series for all metrics of the topic or channel.
+	PausedLabel bool
+
+	// TopicFilter, ChannelFilter and ClientFilter restrict the exported
+	// topics, channels and clients. Clients are filtered by hostname.
+	TopicFilter   Filter
+	ChannelFilter Filter
+	ClientFilter  Filter
+
+	// SkipEphemeral drops all ephemeral topics and channels.
+	SkipEphemeral bool
+
+	// ClientGroupLabels are the labels the clients are grouped by in
+	// ClientsByHostStats. Defaults to DefaultClientGroupLabels.
+	ClientGroupLabels []string
+
+	// AggregateProducerHosts sums up the publishers of a topic over all
+	// hosts in ProducerStats instead of exporting them per host.
+	AggregateProducerHosts bool
+
+	// OrphanedGracePeriod and StalledGracePeriod are the durations a
+	// channel has to be orphaned or stalled before ChannelStats reports it.
+	OrphanedGracePeriod time.Duration
+	StalledGracePeriod  time.Duration
+}
+
+// Validate checks the options for invalid values.
+func (o Options) Validate() error {
+	seen := make(map[string]bool, len(o.ClientGroupLabels))
+	for _, label := range o.ClientGroupLabels {
+		if _, has := clientGroupLabels[label]; !has {
+			return fmt.Errorf("unknown client group label: %s", label)
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate client group label: %s", label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statsVec is a metric vector whose values are replaced by the values
+// reported by nsqd on every scrape.
+type statsVec interface {
+	prometheus.Collector
+	Reset()
+	set(labels prometheus.Labels, v float64)
+}
+
+type gaugeVec struct {
+	*prometheus.GaugeVec
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) statsVec {
+	return gaugeVec{prometheus.NewGaugeVec(opts, labels)}
+}
+
+func (v gaugeVec) set(labels prometheus.Labels, val float64) {
+	v.With(labels).Set(val)
+}
+
+type counterVec struct {
+	*prometheus.CounterVec
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) statsVec {
+	return counterVec{prometheus.NewCounterVec(opts, labels)}
+}
+
+// set relies on the vector being reset before every scrape, so adding the
+// total reported by nsqd to the fresh counter sets its value.
+func (v counterVec) set(labels prometheus.Labels, val float64) {
+	v.With(labels).Add(val)
 }
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"strings"
+	"time"
+)
+
+// conditionTracker tracks since when a condition holds, so it can be
+// reported only after it has held for a grace period. The keys start with
+// the nsqd node. Keys which have been neither updated nor kept between two
+// prunes are forgotten.
+type conditionTracker struct {
+	since map[string]time.Time
+	seen  map[string]bool
+}
+
+func newConditionTracker() *conditionTracker {
+	return &conditionTracker{
+		since: make(map[string]time.Time),
+		seen:  make(map[string]bool),
+	}
+}
+
+// update records whether the condition holds for the key at the given
+// time and returns whether it has held for at least the grace period.
+func (t *conditionTracker) update(key string, holds bool, now time.Time, grace time.Duration) bool {
+	t.seen[key] = true
+	if !holds {
+		delete(t.since, key)
+		return false
+	}
+	since, has := t.since[key]
+	if !has {
+		since = now
+		t.since[key] = since
+	}
+	return now.Sub(since) >= grace
+}
+
+// keep keeps the keys of a node which could not be scraped.
+func (t *conditionTracker) keep(node string) {
+	for key := range t.since {
+		if strings.HasPrefix(key, node+"\xff") {
+			t.seen[key] = true
+		}
+	}
+}
+
+func (t *conditionTracker) prune() {
+	for key := range t.since {
+		if !t.seen[key] {
+			delete(t.since, key)
+		}
+	}
+	t.seen = make(map[string]bool)
+}
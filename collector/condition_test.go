@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConditionTracker(t *testing.T) {
+	tr := newConditionTracker()
+	start := time.Now()
+	const key = "n\xfft\xffc"
+	steps := []struct {
+		holds  bool
+		prune  bool
+		keep   bool
+		expect bool
+	}{
+		{holds: true, expect: false},
+		{holds: true, expect: true},
+		// the scrape of the node failed
+		{keep: true},
+		{holds: true, expect: true},
+		{holds: false, expect: false},
+		{holds: true, expect: false},
+		// the node is gone
+		{prune: true},
+		{holds: true, expect: false},
+	}
+
+	for i, step := range steps {
+		now := start.Add(time.Duration(i) * time.Minute)
+		switch {
+		case step.keep:
+			tr.keep("n")
+		case step.prune:
+		default:
+			if got := tr.update(key, step.holds, now, time.Minute); got != step.expect {
+				t.Errorf("step %d: expected %v, got %v", i, step.expect, got)
+			}
+		}
+		tr.prune()
+	}
+}
+
+func TestChannelConditions(t *testing.T) {
+	c := ChannelStats(Options{Namespace: "nsq", OrphanedGracePeriod: time.Minute, StalledGracePeriod: time.Minute})
+	start := time.Now()
+	stats := func(fetchedAt time.Time, clients ...*Client) *Stats {
+		return &Stats{
+			FetchedAt: fetchedAt,
+			Topics: []*Topic{{
+				Name: "t",
+				Channels: []*Channel{
+					{Name: "orphaned", Depth: 5},
+					{Name: "stalled", Clients: clients},
+				},
+			}},
+		}
+	}
+	client := &Client{ID: "worker"}
+	const (
+		orphaned = `nsq_channel_orphaned{channel="orphaned",nsqd="n",topic="t"}`
+		stalled  = `nsq_channel_stalled{channel="stalled",nsqd="n",topic="t"}`
+	)
+
+	c.Reset()
+	c.Set("n", stats(start, client))
+	values := collectValues(c)
+	if values[orphaned] != 0 || values[stalled] != 0 {
+		t.Errorf("expected no conditions within the grace period, got %v and %v", values[orphaned], values[stalled])
+	}
+
+	// the scrape of n failed
+	c.Reset()
+	c.(nodeKeeper).keep("n")
+
+	c.Reset()
+	c.Set("n", stats(start.Add(2*time.Minute), client))
+	values = collectValues(c)
+	if values[orphaned] != 1 || values[stalled] != 1 {
+		t.Errorf("expected conditions after the grace period, got %v and %v", values[orphaned], values[stalled])
+	}
+
+	// a client is ready again
+	c.Reset()
+	c.Set("n", stats(start.Add(3*time.Minute), &Client{ID: "worker", ReadyCount: 1}))
+	if v := collectValues(c)[stalled]; v != 0 {
+		t.Errorf("expected channel not to be stalled, got %v", v)
+	}
+}
@@ -1,10 +1,10 @@
 package collector
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
+	"context"
+	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -13,55 +13,183 @@ import (
 
 // NsqExecutor collects all NSQ metrics from the registered collectors.
 // This type implements the prometheus.Collector interface and can be
-// registered in the metrics collection.
+// registered in the metrics collection. The executor does not register
+// any metrics on its own, so multiple executors can be used side by side
+// with separate registries.
 //
 // The executor takes the time needed for scraping nsqd stat endpoint and
 // provides an extra metric for this. This metric is labeled with the
-// scrape result ("success" or "error").
+// scrape result ("success" or "error"). Failed scrapes are additionally
+// counted per nsqd node and failure reason.
+//
+// Besides the configured nsqd nodes, the executor can discover nsqd nodes
+// through one or more nsqlookupd instances. The set of discovered nodes is
+// refreshed on every scrape, so nodes which disappear from nsqlookupd are
+// not scraped anymore. If a nsqlookupd instance cannot be reached, the
+// nodes last discovered through it are scraped instead. If lookupd collectors are used, the nsqlookupd
+// instances are monitored themselves as well. They are always queried on
+// collection, even when polling nsqd in the background.
+//
+// The nsqd nodes are scraped in parallel by at most concurrency workers.
+// For every node the executor reports whether the scrape succeeded and
+// how long it took, so a failing node does not hide the metrics of the
+// healthy ones.
+//
+// Instead of scraping nsqd on every collection, the executor can poll the
+// nsqd nodes in the background and serve the last polled stats to any
+// number of scrapers, see StartPolling.
+//
+// Additionally the executor can run a canary against the nsqd nodes,
+// which publishes and consumes messages over the TCP protocol, see
+// StartCanary.
 type NsqExecutor struct {
-	nsqdURL string
+	targets     []node
+	lookupdURLs []string
+	concurrency int
+
+	includeMem   bool
+	includeInfo  bool
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+
+	collectors        []StatsCollector
+	lookupdCollectors []LookupdCollector
+	lookupdUp         *prometheus.GaugeVec
+	summary           *prometheus.SummaryVec
+	up                *prometheus.GaugeVec
+	scrapeDuration    *prometheus.GaugeVec
+	scrapeErrors      *prometheus.CounterVec
+	snapshotAge       *prometheus.GaugeVec
+	lastSuccess       *prometheus.GaugeVec
+	canaryPublished   *prometheus.GaugeVec
+	canaryConsumed    *prometheus.GaugeVec
+	canaryRoundTrip   *prometheus.HistogramVec
+	client            *http.Client
+	mutex             sync.RWMutex
+
+	snapshot   []scrapeResult
+	lastScrape time.Time
+	stop       chan struct{}
+	canaryStop chan struct{}
+	pollMutex  sync.Mutex
+
+	// lastProducers are the nsqd nodes last discovered through each
+	// nsqlookupd instance.
+	lastProducers  map[string][]*LookupdProducer
+	discoveryMutex sync.Mutex
+}
+
+// Target is a nsqd node scraped by the executor.
+type Target struct {
+	// URL is the URL of the stats endpoint of nsqd.
+	URL string
+	// TLS configures the connections to the node. If nil, the TLS
+	// configuration of the executor is used.
+	TLS *TLSConfig
+	// Timeout of the requests to the node. If zero, the deadline of the
+	// collection or the timeout of the executor is used.
+	Timeout time.Duration
+}
 
-	collectors []StatsCollector
-	summary    *prometheus.SummaryVec
-	client     *http.Client
-	mutex      sync.RWMutex
+type node struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+	// tcpAddr is the address of the TCP interface of nsqd, if known.
+	tcpAddr string
 }
 
 // NewNsqExecutor creates a new executor for collecting NSQ metrics.
-func NewNsqExecutor(namespace, nsqdURL, tlsCACert, tlsCert, tlsKey string) (*NsqExecutor, error) {
+// The lookupdURLs must point to the nodes endpoint of nsqlookupd. The
+// other endpoints of nsqlookupd are expected next to it.
+func NewNsqExecutor(namespace string, targets []Target, lookupdURLs []string, concurrency int, tlsConfig TLSConfig) (*NsqExecutor, error) {
 	sum := prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace: namespace,
 		Subsystem: "exporter",
 		Name:      "scrape_duration_seconds",
 		Help:      "Duration of a scrape job of the NSQ exporter",
 	}, []string{"result"})
-	prometheus.MustRegister(sum)
-
-	transport := &http.Transport{}
-	if tlsCert != "" && tlsKey != "" {
-		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
-		if err != nil {
-			return nil, err
-		}
-		caCertPool := x509.NewCertPool()
-		if tlsCACert != "" {
-			caCert, err := ioutil.ReadFile(tlsCACert)
-			if err != nil {
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	client, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]node, len(targets))
+	for i, t := range targets {
+		nodes[i] = node{url: t.URL, client: client, timeout: t.Timeout}
+		if t.TLS != nil {
+			if nodes[i].client, err = newHTTPClient(*t.TLS); err != nil {
 				return nil, err
 			}
-			caCertPool.AppendCertsFromPEM(caCert)
-		}
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			RootCAs:      caCertPool,
 		}
-		tlsConfig.BuildNameToCertificate()
-		transport.TLSClientConfig = tlsConfig
 	}
+
 	return &NsqExecutor{
-		nsqdURL: nsqdURL,
-		summary: sum,
-		client:  &http.Client{Transport: transport},
+		targets:     nodes,
+		lookupdURLs: lookupdURLs,
+		concurrency: concurrency,
+		summary:     sum,
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up",
+			Help:      "Whether the last scrape of the nsqd node was successful",
+		}, []string{"nsqd"}),
+		scrapeDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "node_scrape_duration_seconds",
+			Help:      "Duration of the last scrape of the nsqd node",
+		}, []string{"nsqd"}),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "scrape_errors_total",
+			Help:      "Number of failed scrapes of the nsqd node by reason",
+		}, []string{"nsqd", "reason"}),
+		snapshotAge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "snapshot_age_seconds",
+			Help:      "Age of the served stats of the nsqd node when polling in the background",
+		}, []string{"nsqd"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "last_successful_poll_timestamp_seconds",
+			Help:      "Time of the last successful poll of the nsqd node when polling in the background",
+		}, []string{"nsqd"}),
+		lookupdUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "lookupd",
+			Name:      "up",
+			Help:      "Whether the last scrape of the nsqlookupd instance was successful",
+		}, []string{"lookupd"}),
+		canaryPublished: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "canary",
+			Name:      "publish_success",
+			Help:      "Whether the last canary message has been published to the nsqd node",
+		}, []string{"nsqd"}),
+		canaryConsumed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "canary",
+			Name:      "consume_success",
+			Help:      "Whether the last canary message has been consumed from the nsqd node",
+		}, []string{"nsqd"}),
+		canaryRoundTrip: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "canary",
+			Name:      "round_trip_seconds",
+			Help:      "Time between publishing and consuming a canary message",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"nsqd"}),
+		client:        client,
+		lastProducers: make(map[string][]*LookupdProducer),
 	}, nil
 }
 
@@ -71,42 +199,518 @@ func (e *NsqExecutor) Use(c StatsCollector) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 	e.collectors = append(e.collectors, c)
+	if m, ok := c.(MemoryCollector); ok && m.NeedsMemory() {
+		e.includeMem = true
+	}
+	if i, ok := c.(InfoCollector); ok && i.NeedsInfo() {
+		e.includeInfo = true
+	}
+}
+
+// UseLookupd configures a specific lookupd collector, so the state of the
+// nsqlookupd instances could be exposed to the Prometheus system.
+func (e *NsqExecutor) UseLookupd(c LookupdCollector) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lookupdCollectors = append(e.lookupdCollectors, c)
+}
+
+// SetTimeout sets the timeout of requests to nsqd and nsqlookupd, which
+// is used if neither the target nor the collection defines a deadline.
+func (e *NsqExecutor) SetTimeout(timeout time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.timeout = timeout
+}
+
+// SetRetries configures how often a failed nsqd scrape is retried. The
+// backoff between the attempts is doubled after every attempt.
+func (e *NsqExecutor) SetRetries(retries int, backoff time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.retries = retries
+	e.retryBackoff = backoff
 }
 
 // Describe implements the prometheus.Collector interface.
 func (e *NsqExecutor) Describe(ch chan<- *prometheus.Desc) {
+	e.summary.Describe(ch)
+	e.up.Describe(ch)
+	e.scrapeDuration.Describe(ch)
+	e.scrapeErrors.Describe(ch)
+	e.snapshotAge.Describe(ch)
+	e.lastSuccess.Describe(ch)
+	e.lookupdUp.Describe(ch)
+	e.canaryPublished.Describe(ch)
+	e.canaryConsumed.Describe(ch)
+	e.canaryRoundTrip.Describe(ch)
 	for _, c := range e.collectors {
-		c.describe(ch)
+		c.Describe(ch)
+	}
+	for _, c := range e.lookupdCollectors {
+		c.Describe(ch)
 	}
 }
 
 // Collect implements the prometheus.Collector interface.
 func (e *NsqExecutor) Collect(out chan<- prometheus.Metric) {
-	start := time.Now()
+	e.collect(context.Background(), out)
+}
+
+// WithContext returns a prometheus.Collector collecting the metrics of
+// the executor. Requests to nsqd are canceled when the given context is
+// done, e.g. when the scraper disconnects or its scrape timeout expires.
+func (e *NsqExecutor) WithContext(ctx context.Context) prometheus.Collector {
+	return contextCollector{e: e, ctx: ctx}
+}
+
+type contextCollector struct {
+	e   *NsqExecutor
+	ctx context.Context
+}
+
+func (c contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.e.Describe(ch)
+}
+
+func (c contextCollector) Collect(out chan<- prometheus.Metric) {
+	c.e.collect(c.ctx, out)
+}
+
+func (e *NsqExecutor) collect(ctx context.Context, out chan<- prometheus.Metric) {
+	e.mutex.RLock()
+	lookupdUsed := len(e.lookupdCollectors) > 0
+	e.mutex.RUnlock()
+
+	// the nsqd nodes are discovered once and used for both scrapes
+	var discovered []discovery
+	polling := e.isPolling()
+	if !polling || lookupdUsed {
+		discovered = e.discover(ctx)
+	}
+
+	var results []scrapeResult
+	if polling {
+		results = e.lastSnapshot()
+	} else {
+		results = e.scrapeAll(ctx, discovered)
+	}
+	var lookupds []lookupdResult
+	if lookupdUsed {
+		lookupds = e.scrapeLookupds(ctx, discovered)
+	}
+
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
 	// reset state, because metrics can gone
+	e.up.Reset()
+	e.scrapeDuration.Reset()
+	e.snapshotAge.Reset()
+	e.lastSuccess.Reset()
+	e.lookupdUp.Reset()
+	for _, c := range e.collectors {
+		c.Reset()
+	}
+	for _, c := range e.lookupdCollectors {
+		c.Reset()
+	}
+
+	now := time.Now()
+	for _, r := range results {
+		e.scrapeDuration.WithLabelValues(r.node).Set(r.duration.Seconds())
+		if r.err != nil {
+			e.up.WithLabelValues(r.node).Set(0)
+		} else {
+			e.up.WithLabelValues(r.node).Set(1)
+		}
+		if polling && !r.lastSuccess.IsZero() {
+			e.snapshotAge.WithLabelValues(r.node).Set(now.Sub(r.lastSuccess).Seconds())
+			e.lastSuccess.WithLabelValues(r.node).Set(float64(r.lastSuccess.UnixNano()) / 1e9)
+		}
+
+		if r.stats == nil {
+			for _, c := range e.collectors {
+				if k, ok := c.(nodeKeeper); ok {
+					k.keep(r.node)
+				}
+			}
+			continue
+		}
+		for _, c := range e.collectors {
+			c.Set(r.node, r.stats)
+		}
+	}
+
+	for _, r := range lookupds {
+		if r.err != nil {
+			e.lookupdUp.WithLabelValues(r.lookupd).Set(0)
+			continue
+		}
+		e.lookupdUp.WithLabelValues(r.lookupd).Set(1)
+		for _, c := range e.lookupdCollectors {
+			c.Set(r.lookupd, r.stats)
+		}
+	}
+
+	e.summary.Collect(out)
+	e.up.Collect(out)
+	e.scrapeDuration.Collect(out)
+	e.scrapeErrors.Collect(out)
+	if polling {
+		e.snapshotAge.Collect(out)
+		e.lastSuccess.Collect(out)
+	}
+	if len(e.lookupdCollectors) > 0 {
+		e.lookupdUp.Collect(out)
+	}
+	e.canaryPublished.Collect(out)
+	e.canaryConsumed.Collect(out)
+	e.canaryRoundTrip.Collect(out)
 	for _, c := range e.collectors {
-		c.reset()
+		c.Collect(out)
+	}
+	for _, c := range e.lookupdCollectors {
+		c.Collect(out)
+	}
+}
+
+// StartPolling makes the executor poll the nsqd nodes in the given
+// interval in the background. Scrapes are served from the last
+// successfully polled stats of every node instead of querying nsqd.
+func (e *NsqExecutor) StartPolling(interval time.Duration) {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	if e.stop != nil {
+		return
+	}
+	e.stop = make(chan struct{})
+
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			e.poll()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(e.stop)
+}
+
+// Stop stops polling the nsqd nodes and running the canary in the
+// background.
+func (e *NsqExecutor) Stop() {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+	if e.canaryStop != nil {
+		close(e.canaryStop)
+		e.canaryStop = nil
 	}
+}
+
+func (e *NsqExecutor) isPolling() bool {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	return e.stop != nil
+}
+
+// poll scrapes all nodes and replaces the snapshot. Nodes which could
+// not be scraped keep their last successfully scraped stats.
+func (e *NsqExecutor) poll() {
+	ctx := context.Background()
+	results := e.scrapeAll(ctx, e.discover(ctx))
+
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+
+	last := make(map[string]scrapeResult, len(e.snapshot))
+	for _, r := range e.snapshot {
+		last[r.node] = r
+	}
+	for i, r := range results {
+		if r.err == nil {
+			continue
+		}
+		if l, has := last[r.node]; has {
+			results[i].stats = l.stats
+			results[i].lastSuccess = l.lastSuccess
+		}
+	}
+	e.snapshot = results
+}
+
+func (e *NsqExecutor) lastSnapshot() []scrapeResult {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	return e.snapshot
+}
+
+// LastSuccess returns the start time of the last successful scrape of any
+// nsqd node, either while polling or on a scrape of the executor. It is
+// zero if no node has been scraped successfully yet.
+func (e *NsqExecutor) LastSuccess() time.Time {
+	e.pollMutex.Lock()
+	defer e.pollMutex.Unlock()
+	return e.lastScrape
+}
 
-	stats, err := getNsqdStats(e.client, e.nsqdURL)
-	tScrape := time.Since(start).Seconds()
+type scrapeResult struct {
+	node        string
+	stats       *Stats
+	err         error
+	duration    time.Duration
+	lastSuccess time.Time
+}
+
+// scrapeAll scrapes the configured and the discovered nodes and observes
+// the time needed.
+func (e *NsqExecutor) scrapeAll(ctx context.Context, discovered []discovery) []scrapeResult {
+	start := time.Now()
+	results := e.scrape(ctx, e.nodes(discovered))
 
 	result := "success"
+	for _, r := range results {
+		if r.err != nil {
+			result = "error"
+		}
+	}
+	e.summary.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return results
+}
+
+// scrape fetches the stats of the given nsqd nodes in parallel. The
+// results are returned in the order of the given nodes.
+func (e *NsqExecutor) scrape(ctx context.Context, nodes []node) []scrapeResult {
+	results := make([]scrapeResult, len(nodes))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < e.concurrency && i < len(nodes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx] = e.scrapeNode(ctx, nodes[idx])
+			}
+		}()
+	}
+
+	for idx := range nodes {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func (e *NsqExecutor) scrapeNode(ctx context.Context, n node) scrapeResult {
+	e.mutex.RLock()
+	timeout, retries, backoff := defaultTimeout(ctx, e.timeout), e.retries, e.retryBackoff
+	includeMem, includeInfo := e.includeMem, e.includeInfo
+	e.mutex.RUnlock()
+	if n.timeout > 0 {
+		timeout = n.timeout
+	}
+	if includeMem {
+		n.url = withQuery(n.url, "include_mem", "true")
+	}
+
+	start := time.Now()
+	r := scrapeResult{node: nodeName(n.url)}
+	for attempt := 0; ; attempt++ {
+		r.stats, r.err = e.fetchStats(ctx, n, timeout, includeInfo)
+		if r.err == nil || attempt >= retries || ctx.Err() != nil {
+			break
+		}
+
+		log.Printf("error scraping nsqd %s, retrying: %v", r.node, r.err)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+		}
+	}
+	r.duration = time.Since(start)
+
+	if r.err != nil {
+		log.Printf("error scraping nsqd %s: %v", r.node, r.err)
+		if serr, ok := r.err.(*scrapeError); ok {
+			e.scrapeErrors.WithLabelValues(r.node, serr.reason).Inc()
+		}
+	} else {
+		r.lastSuccess = start
+		e.pollMutex.Lock()
+		if start.After(e.lastScrape) {
+			e.lastScrape = start
+		}
+		e.pollMutex.Unlock()
+	}
+	return r
+}
+
+// fetchStats fetches the stats of the node and, if includeInfo is set,
+// its node info. The requests are canceled after the given timeout or, if
+// the timeout is zero, when ctx is done. Failing to fetch the node info
+// does not fail the scrape.
+func (e *NsqExecutor) fetchStats(ctx context.Context, n node, timeout time.Duration, includeInfo bool) (*Stats, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	s, err := getNsqdStats(ctx, n.client, n.url)
 	if err != nil {
-		result = "error"
+		return nil, err
+	}
+	s.FetchedAt = time.Now()
+	if !includeInfo {
+		return s, nil
+	}
+	if s.Info, err = getNsqdInfo(ctx, n.client, n.url); err != nil {
+		log.Printf("error fetching info of nsqd %s: %v", nodeName(n.url), err)
 	}
+	return s, nil
+}
 
-	e.summary.WithLabelValues(result).Observe(tScrape)
+// withTimeout applies the timeout to the context, unless the timeout is
+// zero or the context already has an earlier deadline.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	if err == nil {
-		for _, c := range e.collectors {
-			c.set(stats)
+// defaultTimeout returns the timeout of the executor to apply to ctx. It
+// is zero if ctx already has a deadline, e.g. from the scrape timeout of
+// Prometheus, so that deadline is used instead.
+func defaultTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if _, has := ctx.Deadline(); has {
+		return 0
+	}
+	return timeout
+}
+
+// nodes returns all nsqd nodes to scrape: the configured
+// ones and the ones discovered through the nsqlookupd instances.
+func (e *NsqExecutor) nodes(discovered []discovery) []node {
+	seen := make(map[string]bool, len(e.targets))
+	nodes := make([]node, 0, len(e.targets))
+	add := func(n node) {
+		if name := nodeName(n.url); !seen[name] {
+			seen[name] = true
+			nodes = append(nodes, n)
 		}
-		for _, c := range e.collectors {
-			c.collect(out)
+	}
+
+	for _, n := range e.targets {
+		add(n)
+	}
+	for _, d := range discovered {
+		for _, p := range d.producers {
+			add(node{url: p.statsURL(), client: e.client, tcpAddr: p.tcpAddr()})
 		}
 	}
+	return nodes
+}
+
+// discovery are the nsqd nodes currently registered at a nsqlookupd
+// instance.
+type discovery struct {
+	lookupdURL string
+	producers  []*LookupdProducer
+	err        error
+}
+
+// discover fetches the registered nsqd nodes from all nsqlookupd
+// instances in parallel. If the nodes of an instance cannot be fetched,
+// the ones of its last successful discovery are returned along with the
+// error.
+func (e *NsqExecutor) discover(ctx context.Context) []discovery {
+	discovered := make([]discovery, len(e.lookupdURLs))
+	var wg sync.WaitGroup
+	for i, lookupdURL := range e.lookupdURLs {
+		wg.Add(1)
+		go func(i int, lookupdURL string) {
+			defer wg.Done()
+			d := discovery{lookupdURL: lookupdURL}
+			d.producers, d.err = e.fetchLookupdNodes(ctx, lookupdURL)
+
+			e.discoveryMutex.Lock()
+			if d.err != nil {
+				d.producers = e.lastProducers[lookupdURL]
+				log.Printf("error discovering nsqd nodes through %s, reusing %d previously discovered nodes: %v", lookupdURL, len(d.producers), d.err)
+			} else {
+				e.lastProducers[lookupdURL] = d.producers
+			}
+			e.discoveryMutex.Unlock()
+			discovered[i] = d
+		}(i, lookupdURL)
+	}
+	wg.Wait()
+	return discovered
+}
+
+func (e *NsqExecutor) fetchLookupdNodes(ctx context.Context, lookupdURL string) ([]*LookupdProducer, error) {
+	e.mutex.RLock()
+	timeout := defaultTimeout(ctx, e.timeout)
+	e.mutex.RUnlock()
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	return getLookupdNodes(ctx, e.client, lookupdURL)
+}
+
+type lookupdResult struct {
+	lookupd string
+	stats   *LookupdStats
+	err     error
+}
+
+// scrapeLookupds fetches the state of all nsqlookupd instances in
+// parallel, reusing the nodes discovered through them.
+func (e *NsqExecutor) scrapeLookupds(ctx context.Context, discovered []discovery) []lookupdResult {
+	e.mutex.RLock()
+	timeout := defaultTimeout(ctx, e.timeout)
+	e.mutex.RUnlock()
+
+	results := make([]lookupdResult, len(discovered))
+	var wg sync.WaitGroup
+	for i, d := range discovered {
+		wg.Add(1)
+		go func(i int, d discovery) {
+			defer wg.Done()
+			ctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+
+			r := lookupdResult{lookupd: nodeName(d.lookupdURL), err: d.err}
+			if r.err != nil {
+				// already logged by the discovery
+				results[i] = r
+				return
+			}
+			if r.err = pingLookupd(ctx, e.client, d.lookupdURL); r.err == nil {
+				r.stats, r.err = getLookupdStats(ctx, e.client, d.lookupdURL, d.producers)
+			}
+			if r.err != nil {
+				log.Printf("error scraping nsqlookupd %s: %v", r.lookupd, r.err)
+			}
+			results[i] = r
+		}(i, d)
+	}
+	wg.Wait()
+	return results
+}
+
+// nodeName returns the value of the nsqd label for the given stats URL.
+func nodeName(nsqdURL string) string {
+	u, err := url.Parse(nsqdURL)
+	if err != nil {
+		return nsqdURL
+	}
+	return u.Host
 }
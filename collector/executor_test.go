@@ -0,0 +1,76 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScrapeTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"version":"1.2.0","health":"OK"}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		target   time.Duration
+		success  bool
+	}{
+		{name: "executor timeout", success: false},
+		{name: "collection deadline", deadline: time.Second, success: true},
+		{name: "target timeout", deadline: time.Second, target: 50 * time.Millisecond, success: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewNsqExecutor("nsq", []Target{{URL: srv.URL + "/stats", Timeout: tt.target}}, nil, 1, TLSConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.SetTimeout(50 * time.Millisecond)
+
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			r := e.scrapeNode(ctx, e.targets[0])
+			if success := r.err == nil; success != tt.success {
+				t.Errorf("expected success %v, got error %v", tt.success, r.err)
+			}
+		})
+	}
+}
+
+func TestDiscoverFailure(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"producers":[{"broadcast_address":"nsqd-1","http_port":4151,"tcp_port":4150}]}`))
+	}))
+	defer srv.Close()
+
+	e, err := NewNsqExecutor("nsq", nil, []string{srv.URL + "/nodes"}, 1, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fail = range []bool{false, true} {
+		discovered := e.discover(context.Background())
+		if (discovered[0].err != nil) != fail {
+			t.Errorf("expected failure %v, got error %v", fail, discovered[0].err)
+		}
+		nodes := e.nodes(discovered)
+		if len(nodes) != 1 || nodeName(nodes[0].url) != "nsqd-1:4151" {
+			t.Errorf("expected node nsqd-1:4151, got %v", nodes)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Filter restricts the exported topics, channels or clients by their name.
+// A name is exported if it matches Include and does not match Exclude.
+// Unset expressions are ignored.
+type Filter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+func (f Filter) match(name string) bool {
+	if f.Include != nil && !f.Include.MatchString(name) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+func isEphemeral(name string) bool {
+	return strings.HasSuffix(name, "#ephemeral")
+}
+
+func (o Options) topicAllowed(t *Topic) bool {
+	if o.SkipEphemeral && isEphemeral(t.Name) {
+		return false
+	}
+	return o.TopicFilter.match(t.Name)
+}
+
+func (o Options) channelAllowed(c *Channel) bool {
+	if o.SkipEphemeral && isEphemeral(c.Name) {
+		return false
+	}
+	return o.ChannelFilter.match(c.Name)
+}
+
+func (o Options) clientAllowed(c *Client) bool {
+	return o.ClientFilter.match(c.Hostname)
+}
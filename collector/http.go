@@ -0,0 +1,78 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiResponse is the response envelope of nsqd and nsqlookupd < 1.0. The
+// wrapped data is decoded separately.
+type apiResponse struct {
+	StatusCode int             `json:"status_code"`
+	StatusText string          `json:"status_txt"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// getJSON fetches the given endpoint of nsqd or nsqlookupd and decodes the
+// response into v.
+func getJSON(ctx context.Context, client *http.Client, endpoint string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP status %s", endpoint, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// nsqd and nsqlookupd >= 1.0 do not wrap their responses
+	var ar apiResponse
+	if err = json.Unmarshal(body, &ar); err == nil && ar.StatusCode != 0 {
+		if ar.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned status code %d: %s", endpoint, ar.StatusCode, ar.StatusText)
+		}
+		body = ar.Data
+	}
+	return json.Unmarshal(body, v)
+}
+
+// endpointURL returns the URL of another endpoint of the same nsqd or
+// nsqlookupd instance by replacing the last element of the path.
+func endpointURL(rawURL, endpoint string, query url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if i := strings.LastIndex(u.Path, "/"); i >= 0 {
+		u.Path = u.Path[:i]
+	}
+	u.Path += endpoint
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// withQuery sets the query parameter of the given URL.
+func withQuery(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,71 @@
+package collector
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyVec exposes the e2e processing latency reported by nsqd as
+// summaries. The quantiles are taken from the percentiles nsqd has been
+// configured with, so they are not known in advance. nsqd does not report
+// the sum or the total count of the observed latencies, so the sum of the
+// summaries is NaN and the count is zero. The number of latencies in the
+// rolling window of nsqd goes up and down, so it is exported as a gauge.
+type latencyVec struct {
+	desc      *prometheus.Desc
+	countDesc *prometheus.Desc
+	labels    []string
+	metrics   []prometheus.Metric
+}
+
+func newLatencyVec(namespace string, labels []string) *latencyVec {
+	return &latencyVec{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "e2e_processing_latency_seconds"),
+			"End to end processing latency of messages in the rolling window of nsqd, sum and count are not reported",
+			labels, nil,
+		),
+		countDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "e2e_processing_latency_window_count"),
+			"Number of messages in the rolling window of the end to end processing latency",
+			labels, nil,
+		),
+		labels: labels,
+	}
+}
+
+func (v *latencyVec) set(labels prometheus.Labels, l *E2eLatency) {
+	if len(l.Percentiles) == 0 {
+		return
+	}
+
+	quantiles := make(map[float64]float64, len(l.Percentiles))
+	for _, p := range l.Percentiles {
+		// nsqd reports the latency in nanoseconds
+		quantiles[p.Quantile] = p.Value / 1e9
+	}
+	values := make([]string, len(v.labels))
+	for i, name := range v.labels {
+		values[i] = labels[name]
+	}
+	v.metrics = append(v.metrics,
+		prometheus.MustNewConstSummary(v.desc, 0, math.NaN(), quantiles, values...),
+		prometheus.MustNewConstMetric(v.countDesc, prometheus.GaugeValue, float64(l.Count), values...),
+	)
+}
+
+func (v *latencyVec) Collect(out chan<- prometheus.Metric) {
+	for _, m := range v.metrics {
+		out <- m
+	}
+}
+
+func (v *latencyVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+	ch <- v.countDesc
+}
+
+func (v *latencyVec) Reset() {
+	v.metrics = nil
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type lookupdNodes struct {
+	Producers []*LookupdProducer `json:"producers"`
+}
+
+type lookupdTopics struct {
+	Topics []string `json:"topics"`
+}
+
+type lookupdChannels struct {
+	Channels []string `json:"channels"`
+}
+
+// LookupdProducer is a nsqd node registered at nsqlookupd.
+// see https://github.com/nsqio/nsq/blob/master/nsqlookupd/http.go
+type LookupdProducer struct {
+	RemoteAddress    string   `json:"remote_address"`
+	Hostname         string   `json:"hostname"`
+	BroadcastAddress string   `json:"broadcast_address"`
+	TCPPort          int      `json:"tcp_port"`
+	HTTPPort         int      `json:"http_port"`
+	Version          string   `json:"version"`
+	Tombstones       []bool   `json:"tombstones"`
+	Topics           []string `json:"topics"`
+}
+
+// peer is a producer as reported by the debug endpoint of nsqlookupd.
+type peer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	HTTPPort         int    `json:"http_port"`
+	LastUpdate       int64  `json:"last_update"`
+}
+
+// LookupdStats is the state of a nsqlookupd instance.
+type LookupdStats struct {
+	Producers []*LookupdProducer
+	Topics    []string
+	// Channels maps the registered topics to their channels.
+	Channels map[string][]string
+	// LastUpdate is the time of the last heartbeat of every producer,
+	// keyed by the name of the nsqd node.
+	LastUpdate map[string]time.Time
+}
+
+// node returns the value of the nsqd label of the producer, which matches
+// the label of the node when it is scraped after discovery.
+func (p *LookupdProducer) node() string {
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HTTPPort))
+}
+
+// tcpAddr returns the address of the TCP interface of the producer.
+func (p *LookupdProducer) tcpAddr() string {
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort))
+}
+
+// statsURL returns the URL of the stats endpoint of the producer.
+func (p *LookupdProducer) statsURL() string {
+	return "http://" + p.node() + "/stats?format=json"
+}
+
+func getLookupdNodes(ctx context.Context, client *http.Client, lookupdURL string) ([]*LookupdProducer, error) {
+	var nodes lookupdNodes
+	if err := getJSON(ctx, client, lookupdURL, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes.Producers, nil
+}
+
+// pingLookupd checks the health of the nsqlookupd instance whose nodes
+// endpoint is nodesURL.
+func pingLookupd(ctx context.Context, client *http.Client, nodesURL string) error {
+	pingURL := endpointURL(nodesURL, "/ping", nil)
+	req, err := http.NewRequest("GET", pingURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("nsqlookupd %s returned HTTP status %s", pingURL, resp.Status)
+	}
+	return nil
+}
+
+// maxLookupdRequests is the maximum number of parallel requests to a
+// nsqlookupd instance when fetching the channels of its topics.
+const maxLookupdRequests = 8
+
+// getLookupdStats fetches the registered topics and channels and the last
+// heartbeats of the producers from the nsqlookupd instance whose nodes
+// endpoint is nodesURL. The producers are the ones already fetched from
+// the nodes endpoint when discovering the nsqd nodes.
+func getLookupdStats(ctx context.Context, client *http.Client, nodesURL string, producers []*LookupdProducer) (*LookupdStats, error) {
+	s := &LookupdStats{
+		Producers:  producers,
+		Channels:   make(map[string][]string),
+		LastUpdate: make(map[string]time.Time),
+	}
+
+	var topics lookupdTopics
+	err := getJSON(ctx, client, endpointURL(nodesURL, "/topics", nil), &topics)
+	if err != nil {
+		return nil, err
+	}
+	s.Topics = topics.Topics
+
+	channels := make([]lookupdChannels, len(s.Topics))
+	errs := make([]error, len(s.Topics))
+	sem := make(chan struct{}, maxLookupdRequests)
+	var wg sync.WaitGroup
+	for i, t := range s.Topics {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			channelsURL := endpointURL(nodesURL, "/channels", url.Values{"topic": {t}})
+			errs[i] = getJSON(ctx, client, channelsURL, &channels[i])
+		}(i, t)
+	}
+	wg.Wait()
+	for i, t := range s.Topics {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		s.Channels[t] = channels[i].Channels
+	}
+
+	// The debug endpoint lists every registration of every producer. The
+	// client registrations are updated on every heartbeat of nsqd.
+	var debug map[string][]*peer
+	if err = getJSON(ctx, client, endpointURL(nodesURL, "/debug", nil), &debug); err != nil {
+		return nil, err
+	}
+	for _, p := range debug["client::"] {
+		name := net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HTTPPort))
+		s.LastUpdate[name] = time.Unix(0, p.LastUpdate)
+	}
+	return s, nil
+}
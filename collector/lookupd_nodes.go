@@ -0,0 +1,89 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type lookupdNodeStats struct {
+	producers  statsVec
+	lastUpdate statsVec
+	topics     statsVec
+	tombstones statsVec
+}
+
+// LookupdNodeStats creates a new lookupd collector which is able to
+// expose the nsqd nodes registered at nsqlookupd. The age of the last
+// heartbeat of a node allows alerting on nodes which stopped reporting to
+// nsqlookupd.
+func LookupdNodeStats(opts Options) LookupdCollector {
+	namespace := opts.Namespace + "_lookupd"
+	labels := []string{"lookupd", "nsqd"}
+
+	return lookupdNodeStats{
+		producers: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "producer_count",
+			Help:      "Number of nsqd nodes registered at nsqlookupd",
+		}, []string{"lookupd"}),
+		lastUpdate: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "producer_last_update_age_seconds",
+			Help:      "Time since the last heartbeat of the nsqd node",
+		}, labels),
+		topics: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "producer_topic_count",
+			Help:      "Number of topics registered by the nsqd node",
+		}, labels),
+		tombstones: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "producer_tombstoned_topic_count",
+			Help:      "Number of tombstoned topics of the nsqd node",
+		}, labels),
+	}
+}
+
+func (ns lookupdNodeStats) Set(lookupd string, s *LookupdStats) {
+	ns.producers.set(prometheus.Labels{"lookupd": lookupd}, float64(len(s.Producers)))
+
+	now := time.Now()
+	for _, p := range s.Producers {
+		labels := prometheus.Labels{"lookupd": lookupd, "nsqd": p.node()}
+
+		tombstoned := 0
+		for _, t := range p.Tombstones {
+			if t {
+				tombstoned++
+			}
+		}
+		ns.topics.set(labels, float64(len(p.Topics)))
+		ns.tombstones.set(labels, float64(tombstoned))
+		if last, has := s.LastUpdate[p.node()]; has {
+			ns.lastUpdate.set(labels, now.Sub(last).Seconds())
+		}
+	}
+}
+
+func (ns lookupdNodeStats) vecs() []statsVec {
+	return []statsVec{ns.producers, ns.lastUpdate, ns.topics, ns.tombstones}
+}
+
+func (ns lookupdNodeStats) Collect(out chan<- prometheus.Metric) {
+	for _, v := range ns.vecs() {
+		v.Collect(out)
+	}
+}
+
+func (ns lookupdNodeStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range ns.vecs() {
+		v.Describe(ch)
+	}
+}
+
+func (ns lookupdNodeStats) Reset() {
+	for _, v := range ns.vecs() {
+		v.Reset()
+	}
+}
@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type lookupdTopicStats struct {
+	topics    statsVec
+	producers statsVec
+	channels  statsVec
+	channel   statsVec
+	opts      Options
+}
+
+// LookupdTopicStats creates a new lookupd collector which is able to
+// expose the topics and channels registered at nsqlookupd. The topic and
+// channel filters of the options apply.
+func LookupdTopicStats(opts Options) LookupdCollector {
+	namespace := opts.Namespace + "_lookupd"
+
+	return lookupdTopicStats{
+		topics: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "topic_count",
+			Help:      "Number of topics registered at nsqlookupd",
+		}, []string{"lookupd"}),
+		producers: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "topic_producer_count",
+			Help:      "Number of nsqd nodes producing the topic",
+		}, []string{"lookupd", "topic"}),
+		channels: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "topic_channel_count",
+			Help:      "Number of channels of the topic registered at nsqlookupd",
+		}, []string{"lookupd", "topic"}),
+		channel: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "channel_registered",
+			Help:      "Channel registered at nsqlookupd, always 1",
+		}, []string{"lookupd", "topic", "channel"}),
+		opts: opts,
+	}
+}
+
+func (ts lookupdTopicStats) Set(lookupd string, s *LookupdStats) {
+	ts.topics.set(prometheus.Labels{"lookupd": lookupd}, float64(len(s.Topics)))
+
+	producers := make(map[string]int, len(s.Topics))
+	for _, p := range s.Producers {
+		for _, t := range p.Topics {
+			producers[t]++
+		}
+	}
+
+	for _, t := range s.Topics {
+		if !ts.opts.topicAllowed(&Topic{Name: t}) {
+			continue
+		}
+		labels := prometheus.Labels{"lookupd": lookupd, "topic": t}
+		ts.producers.set(labels, float64(producers[t]))
+		ts.channels.set(labels, float64(len(s.Channels[t])))
+
+		for _, c := range s.Channels[t] {
+			if !ts.opts.channelAllowed(&Channel{Name: c}) {
+				continue
+			}
+			ts.channel.set(prometheus.Labels{"lookupd": lookupd, "topic": t, "channel": c}, 1)
+		}
+	}
+}
+
+func (ts lookupdTopicStats) vecs() []statsVec {
+	return []statsVec{ts.topics, ts.producers, ts.channels, ts.channel}
+}
+
+func (ts lookupdTopicStats) Collect(out chan<- prometheus.Metric) {
+	for _, v := range ts.vecs() {
+		v.Collect(out)
+	}
+}
+
+func (ts lookupdTopicStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range ts.vecs() {
+		v.Describe(ch)
+	}
+}
+
+func (ts lookupdTopicStats) Reset() {
+	for _, v := range ts.vecs() {
+		v.Reset()
+	}
+}
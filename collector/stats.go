@@ -1,35 +1,83 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type statsResponse struct {
 	StatusCode int    `json:"status_code"`
-	StatusText string `json:"status_text"`
-	Data       stats  `json:"data"`
+	StatusText string `json:"status_txt"`
+	Data       *Stats `json:"data"`
+
+	// nsqd >= 1.0 does not wrap the stats into a response envelope
+	Stats
 }
 
-type stats struct {
-	Version   string   `json:"version"`
-	Health    string   `json:"health"`
-	StartTime int64    `json:"start_time"`
-	Topics    []*topic `json:"topics"`
+// Stats are the stats of a nsqd node as reported by its stats endpoint.
+type Stats struct {
+	Version   string    `json:"version"`
+	Health    string    `json:"health"`
+	StartTime int64     `json:"start_time"`
+	Topics    []*Topic  `json:"topics"`
+	Memory    *MemStats `json:"memory"`
+	Producers []*Client `json:"producers"`
+
+	// Info is fetched from the info and config endpoints of nsqd, if a
+	// collector of the executor needs it, see InfoCollector.
+	Info *NodeInfo `json:"-"`
+	// FetchedAt is the time the stats have been received from nsqd.
+	FetchedAt time.Time `json:"-"`
 }
 
+// NodeInfo describes a nsqd node as reported by its info endpoint.
+// see https://github.com/nsqio/nsq/blob/master/nsqd/http.go
+type NodeInfo struct {
+	Version          string `json:"version"`
+	BroadcastAddress string `json:"broadcast_address"`
+	Hostname         string `json:"hostname"`
+	HTTPPort         int    `json:"http_port"`
+	TCPPort          int    `json:"tcp_port"`
+	StartTime        int64  `json:"start_time"`
+	MaxMsgSize       int64  `json:"-"`
+}
+
+// MemStats are the Go runtime memory statistics of nsqd, which are only
+// reported if requested by the include_mem parameter, i.e. if a collector
+// of the executor needs them, see MemoryCollector.
+type MemStats struct {
+	HeapObjects       uint64 `json:"heap_objects"`
+	HeapIdleBytes     uint64 `json:"heap_idle_bytes"`
+	HeapInUseBytes    uint64 `json:"heap_in_use_bytes"`
+	HeapReleasedBytes uint64 `json:"heap_released_bytes"`
+	GCPauseUsec100    uint64 `json:"gc_pause_usec_100"`
+	GCPauseUsec99     uint64 `json:"gc_pause_usec_99"`
+	GCPauseUsec95     uint64 `json:"gc_pause_usec_95"`
+	NextGCBytes       uint64 `json:"next_gc_bytes"`
+	GCTotalRuns       uint32 `json:"gc_total_runs"`
+}
+
+// Topic are the stats of a topic and its channels.
 // see https://github.com/nsqio/nsq/blob/master/nsqd/stats.go
-type topic struct {
+type Topic struct {
 	Name         string     `json:"topic_name"`
 	Paused       bool       `json:"paused"`
 	Depth        int64      `json:"depth"`
 	BackendDepth int64      `json:"backend_depth"`
 	MessageCount uint64     `json:"message_count"`
-	E2eLatency   e2elatency `json:"e2e_processing_latency"`
-	Channels     []*channel `json:"channels"`
+	E2eLatency   E2eLatency `json:"e2e_processing_latency"`
+	Channels     []*Channel `json:"channels"`
 }
 
-type channel struct {
+// Channel are the stats of a channel and its clients.
+type Channel struct {
 	Name          string     `json:"channel_name"`
 	Paused        bool       `json:"paused"`
 	Depth         int64      `json:"depth"`
@@ -39,23 +87,26 @@ type channel struct {
 	DeferredCount int        `json:"deferred_count"`
 	RequeueCount  uint64     `json:"requeue_count"`
 	TimeoutCount  uint64     `json:"timeout_count"`
-	E2eLatency    e2elatency `json:"e2e_processing_latency"`
-	Clients       []*client  `json:"clients"`
+	E2eLatency    E2eLatency `json:"e2e_processing_latency"`
+	Clients       []*Client  `json:"clients"`
 }
 
-type e2elatency struct {
-	Count       int                  `json:"count"`
-	Percentiles []map[string]float64 `json:"percentiles"`
+// E2eLatency is the end to end processing latency of the messages of a
+// topic or channel.
+type E2eLatency struct {
+	Count       int           `json:"count"`
+	Percentiles []*Percentile `json:"percentiles"`
 }
 
-func (e *e2elatency) percentileValue(idx int) float64 {
-	if idx >= len(e.Percentiles) {
-		return 0
-	}
-	return e.Percentiles[idx]["value"]
+// Percentile is a quantile of the end to end processing latency in
+// nanoseconds.
+type Percentile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
 }
 
-type client struct {
+// Client are the stats of a consumer or producer connected to nsqd.
+type Client struct {
 	ID            string `json:"client_id"`
 	Hostname      string `json:"hostname"`
 	Version       string `json:"version"`
@@ -71,29 +122,113 @@ type client struct {
 	Deflate       bool   `json:"deflate"`
 	Snappy        bool   `json:"snappy"`
 	TLS           bool   `json:"tls"`
+
+	UserAgent        string `json:"user_agent"`
+	TLSVersion       string `json:"tls_version"`
+	TLSCipherSuite   string `json:"tls_cipher_suite"`
+	Authed           bool   `json:"authed"`
+	AuthIdentity     string `json:"auth_identity"`
+	MsgTimeout       int64  `json:"msg_timeout"`
+	OutputBufferSize int64  `json:"output_buffer_size"`
+
+	// PubCounts are only reported for producers.
+	PubCounts []*PubCount `json:"pub_counts"`
 }
 
-func getPercentile(t *topic, percentile int) float64 {
-	if len(t.E2eLatency.Percentiles) > 0 {
-		if percentile == 99 {
-			return t.E2eLatency.Percentiles[0]["value"]
-		} else if percentile == 95 {
-			return t.E2eLatency.Percentiles[1]["value"]
-		}
+// PubCount is the number of messages a producer published to a topic.
+type PubCount struct {
+	Topic string `json:"topic"`
+	Count uint64 `json:"count"`
+}
+
+// Reasons of a failed nsqd scrape.
+const (
+	reasonConnect        = "connect"
+	reasonTimeout        = "timeout"
+	reasonHTTPStatus     = "http_status"
+	reasonDecode         = "decode"
+	reasonNsqdStatusCode = "nsqd_status_code"
+	reasonCanceled       = "canceled"
+)
+
+// scrapeError describes why the stats of a nsqd node could not be scraped.
+type scrapeError struct {
+	reason string
+	err    error
+}
+
+func (e *scrapeError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+// newScrapeError creates a scrapeError with the given reason, unless the
+// error has been caused by a timeout or a canceled scrape.
+func newScrapeError(reason string, err error) *scrapeError {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		reason = reasonTimeout
+	} else if uerr, ok := err.(*url.Error); ok && uerr.Err == context.Canceled {
+		reason = reasonCanceled
 	}
-	return 0
+	return &scrapeError{reason: reason, err: err}
 }
 
-func getNsqdStats(client *http.Client, nsqdURL string) (*stats, error) {
-	resp, err := client.Get(nsqdURL)
+// FetchStats fetches the stats of the nsqd node whose stats endpoint is
+// statsURL, e.g. http://localhost:4151/stats, by the default HTTP client.
+// Unlike the executor, it neither fetches the node info nor retries
+// failed requests.
+func FetchStats(ctx context.Context, statsURL string) (*Stats, error) {
+	s, err := getNsqdStats(ctx, http.DefaultClient, withQuery(statsURL, "format", "json"))
 	if err != nil {
 		return nil, err
 	}
+	s.FetchedAt = time.Now()
+	return s, nil
+}
+
+func getNsqdStats(ctx context.Context, client *http.Client, nsqdURL string) (*Stats, error) {
+	req, err := http.NewRequest("GET", nsqdURL, nil)
+	if err != nil {
+		return nil, newScrapeError(reasonConnect, err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, newScrapeError(reasonConnect, err)
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newScrapeError(reasonHTTPStatus, fmt.Errorf("unexpected HTTP status %s", resp.Status))
+	}
+
 	var sr statsResponse
 	if err = json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, newScrapeError(reasonDecode, err)
+	}
+	// nsqd >= 1.0 does not send a status code
+	if sr.StatusCode == 0 {
+		return &sr.Stats, nil
+	}
+	if sr.StatusCode != http.StatusOK {
+		return nil, newScrapeError(reasonNsqdStatusCode, fmt.Errorf("unexpected nsqd status code %d: %s", sr.StatusCode, sr.StatusText))
+	}
+	if sr.Data == nil {
+		return nil, newScrapeError(reasonDecode, errors.New("nsqd response contains no stats"))
+	}
+	return sr.Data, nil
+}
+
+// getNsqdInfo fetches the node info and the maximum message size of the
+// nsqd node whose stats endpoint is statsURL. nsqd < 1.0 does not report
+// its configuration, so the maximum message size is zero in that case.
+func getNsqdInfo(ctx context.Context, client *http.Client, statsURL string) (*NodeInfo, error) {
+	var info NodeInfo
+	if err := getJSON(ctx, client, endpointURL(statsURL, "/info", nil), &info); err != nil {
 		return nil, err
 	}
-	return &sr.Data, nil
+	if !strings.HasPrefix(info.Version, "0.") {
+		if err := getJSON(ctx, client, endpointURL(statsURL, "/config/max_msg_size", nil), &info.MaxMsgSize); err != nil {
+			return nil, err
+		}
+	}
+	return &info, nil
 }
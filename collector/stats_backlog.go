@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backlogState is the state of a channel kept between two scrapes.
+type backlogState struct {
+	fetchedAt     time.Time
+	topicMessages uint64
+	finishes      map[string]uint64
+	ingress       float64
+	egress        float64
+	hasRates      bool
+	seen          bool
+}
+
+type backlogStats struct {
+	ingress   statsVec
+	egress    statsVec
+	backlog   statsVec
+	drainTime statsVec
+	state     map[string]*backlogState
+	opts      Options
+}
+
+// BacklogStats creates a new stats collector which is able to expose
+// derived metrics of the channels of a nsqd node: the ingress and egress
+// rates, the backlog and the estimated time until the backlog is drained.
+//
+// The rates are computed from the stats of the previous scrape, so they
+// are missing on the first scrape of a channel. The ingress rate is the
+// rate of messages published to the topic, the egress rate the rate of
+// messages finished by the clients of the channel. The time to drain is
+// +Inf if the backlog does not shrink.
+func BacklogStats(opts Options) StatsCollector {
+	labels := []string{"nsqd", "topic", "channel"}
+	namespace := opts.Namespace + "_channel"
+
+	return &backlogStats{
+		ingress: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ingress_messages_per_second",
+			Help:      "Rate of messages published to the topic of the channel",
+		}, labels),
+		egress: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "egress_messages_per_second",
+			Help:      "Rate of messages finished by the clients of the channel",
+		}, labels),
+		backlog: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backlog_messages",
+			Help:      "Number of queued, in flight and deferred messages",
+		}, labels),
+		drainTime: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "drain_time_seconds",
+			Help:      "Estimated time until the backlog is drained at the current rates",
+		}, labels),
+		state: make(map[string]*backlogState),
+		opts:  opts,
+	}
+}
+
+func (bs *backlogStats) Set(node string, s *Stats) {
+	for _, topic := range s.Topics {
+		if !bs.opts.topicAllowed(topic) {
+			continue
+		}
+		for _, channel := range topic.Channels {
+			if !bs.opts.channelAllowed(channel) {
+				continue
+			}
+			labels := prometheus.Labels{
+				"nsqd":    node,
+				"topic":   topic.Name,
+				"channel": channel.Name,
+			}
+			st := bs.update(node+"\xff"+topic.Name+"\xff"+channel.Name, s.FetchedAt, topic, channel)
+
+			backlog := float64(channel.Depth) + float64(channel.InFlightCount) + float64(channel.DeferredCount)
+			bs.backlog.set(labels, backlog)
+			if !st.hasRates {
+				continue
+			}
+			bs.ingress.set(labels, st.ingress)
+			bs.egress.set(labels, st.egress)
+
+			switch {
+			case backlog == 0:
+				bs.drainTime.set(labels, 0)
+			case st.egress > st.ingress:
+				bs.drainTime.set(labels, backlog/(st.egress-st.ingress))
+			default:
+				bs.drainTime.set(labels, math.Inf(1))
+			}
+		}
+	}
+}
+
+// update stores the counters of the channel and computes the rates since
+// the previous scrape. Stats which have already been seen, e.g. when
+// they are served from a poll snapshot, keep the previous rates.
+func (bs *backlogStats) update(key string, fetchedAt time.Time, t *Topic, ch *Channel) *backlogState {
+	prev, has := bs.state[key]
+	if has && !fetchedAt.After(prev.fetchedAt) {
+		prev.seen = true
+		return prev
+	}
+
+	st := &backlogState{
+		fetchedAt:     fetchedAt,
+		topicMessages: t.MessageCount,
+		finishes:      make(map[string]uint64, len(ch.Clients)),
+		seen:          true,
+	}
+	for _, c := range ch.Clients {
+		st.finishes[connKey(c)] = c.FinishCount
+	}
+	bs.state[key] = st
+	if !has {
+		return st
+	}
+
+	elapsed := fetchedAt.Sub(prev.fetchedAt).Seconds()
+	st.ingress = float64(delta(prev.topicMessages, st.topicMessages)) / elapsed
+
+	// Only the clients connected during both scrapes are taken into
+	// account, as the counters of a client are lost on disconnect.
+	var finished uint64
+	for key, n := range st.finishes {
+		if last, ok := prev.finishes[key]; ok {
+			finished += delta(last, n)
+		}
+	}
+	st.egress = float64(finished) / elapsed
+	st.hasRates = true
+	return st
+}
+
+// delta returns the increase of a counter, which is reset on restarts of
+// nsqd.
+func delta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func (bs *backlogStats) vecs() []statsVec {
+	return []statsVec{bs.ingress, bs.egress, bs.backlog, bs.drainTime}
+}
+
+func (bs *backlogStats) Collect(out chan<- prometheus.Metric) {
+	for _, v := range bs.vecs() {
+		v.Collect(out)
+	}
+}
+
+func (bs *backlogStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range bs.vecs() {
+		v.Describe(ch)
+	}
+}
+
+func (bs *backlogStats) keep(node string) {
+	for key, st := range bs.state {
+		if strings.HasPrefix(key, node+"\xff") {
+			st.seen = true
+		}
+	}
+}
+
+// Reset drops the state of the channels which have been neither seen nor
+// kept since the previous reset.
+func (bs *backlogStats) Reset() {
+	for _, v := range bs.vecs() {
+		v.Reset()
+	}
+	for key, st := range bs.state {
+		if !st.seen {
+			delete(bs.state, key)
+		}
+		st.seen = false
+	}
+}
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBacklogStats(t *testing.T) {
+	c := BacklogStats(Options{Namespace: "nsq"})
+	start := time.Now()
+	stats := func(fetchedAt time.Time, messages uint64, clients ...*Client) *Stats {
+		return &Stats{
+			FetchedAt: fetchedAt,
+			Topics: []*Topic{{
+				Name:         "t",
+				MessageCount: messages,
+				Channels:     []*Channel{{Name: "c", Depth: 5, Clients: clients}},
+			}},
+		}
+	}
+	// the client ID defaults to the short hostname, so it is shared by
+	// the connections of a host
+	client := func(addr string, finished uint64) *Client {
+		return &Client{ID: "worker", RemoteAddress: addr, FinishCount: finished}
+	}
+	const labels = `{channel="c",nsqd="n",topic="t"}`
+
+	c.Reset()
+	c.Set("n", stats(start, 1000, client("a:1", 100), client("a:2", 50)))
+	values := collectValues(c)
+	if v := values["nsq_channel_backlog_messages"+labels]; v != 5 {
+		t.Errorf("expected backlog %v, got %v", 5, v)
+	}
+	if _, has := values["nsq_channel_egress_messages_per_second"+labels]; has {
+		t.Error("expected no rates on the first scrape")
+	}
+
+	// the scrape of n failed
+	c.Reset()
+	c.(nodeKeeper).keep("n")
+
+	// a:2 reconnected as a:3
+	c.Reset()
+	c.Set("n", stats(start.Add(2*time.Second), 1008, client("a:1", 120), client("a:3", 5)))
+	values = collectValues(c)
+	if v := values["nsq_channel_ingress_messages_per_second"+labels]; v != 4 {
+		t.Errorf("expected ingress %v, got %v", 4, v)
+	}
+	if v := values["nsq_channel_egress_messages_per_second"+labels]; v != 10 {
+		t.Errorf("expected egress %v, got %v", 10, v)
+	}
+	if v, want := values["nsq_channel_drain_time_seconds"+labels], 5.0/6; math.Abs(v-want) > 1e-9 {
+		t.Errorf("expected drain time %v, got %v", want, v)
+	}
+}
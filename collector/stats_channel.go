@@ -6,132 +6,237 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type channelStats []struct {
-	val func(*channel) float64
-	vec *prometheus.GaugeVec
+type channelMetrics []struct {
+	val func(*Channel) float64
+	vec statsVec
+}
+
+type channelStats struct {
+	metrics  channelMetrics
+	latency  *latencyVec
+	orphaned statsVec
+	stalled  statsVec
+	// orphanedSince and stalledSince track the conditions across scrapes.
+	orphanedSince *conditionTracker
+	stalledSince  *conditionTracker
+	opts          Options
 }
 
 // ChannelStats creates a new stats collector which is able to
 // expose the channel metrics of a nsqd node to Prometheus. The
 // channel metrics are reported per topic.
-func ChannelStats(namespace string) StatsCollector {
-	labels := []string{"topic", "channel", "paused"}
-	namespace += "_channel"
+//
+// A channel is orphaned if messages are queued but no client is
+// connected. It is stalled if clients are connected but none of them is
+// ready to receive messages. Paused channels are neither orphaned nor
+// stalled. The conditions are only reported once they have held for the
+// grace periods given in the options.
+func ChannelStats(opts Options) StatsCollector {
+	labels := []string{"nsqd", "topic", "channel"}
+	if opts.PausedLabel {
+		labels = append(labels, "paused")
+	}
+	namespace := opts.Namespace + "_channel"
 
-	return channelStats{
+	metrics := channelMetrics{
 		{
-			val: func(c *channel) float64 { return float64(len(c.Clients)) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(len(c.Clients)) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "client_count",
 				Help:      "Number of clients",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.Depth) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.Depth) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "depth",
 				Help:      "Queue depth",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.BackendDepth) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.BackendDepth) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "backend_depth",
 				Help:      "Queue backend depth",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.MessageCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.MessageCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "message_count",
-				Help:      "Queue message count",
+				Name:      "messages_total",
+				Help:      "Total number of messages",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.InFlightCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.InFlightCount) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "in_flight_count",
 				Help:      "In flight count",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return c.E2eLatency.percentileValue(0) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "e2e_latency_99p",
-				Help:      "e2e latency 99th percentile",
-			}, labels),
-		},
-		{
-			val: func(c *channel) float64 { return c.E2eLatency.percentileValue(1) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.DeferredCount) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "e2e_latency_95p",
-				Help:      "e2e latency 95th percentile",
+				Name:      "deferred_count",
+				Help:      "Deferred count",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.DeferredCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.RequeueCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "deferred_count",
-				Help:      "Deferred count",
+				Name:      "requeues_total",
+				Help:      "Total number of requeued messages",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.RequeueCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return float64(c.TimeoutCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "requeue_count",
-				Help:      "Requeue Count",
+				Name:      "timeouts_total",
+				Help:      "Total number of timed out messages",
 			}, labels),
 		},
 		{
-			val: func(c *channel) float64 { return float64(c.TimeoutCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Channel) float64 { return boolToFloat(c.Paused) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "timeout_count",
-				Help:      "Timeout count",
+				Name:      "paused",
+				Help:      "Whether the channel is paused",
 			}, labels),
 		},
 	}
+	if opts.LegacyCounters {
+		metrics = append(metrics, channelMetrics{
+			{
+				val: func(c *Channel) float64 { return float64(c.MessageCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "message_count",
+					Help:      "Queue message count",
+				}, labels),
+			},
+			{
+				val: func(c *Channel) float64 { return float64(c.RequeueCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "requeue_count",
+					Help:      "Requeue Count",
+				}, labels),
+			},
+			{
+				val: func(c *Channel) float64 { return float64(c.TimeoutCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "timeout_count",
+					Help:      "Timeout count",
+				}, labels),
+			},
+		}...)
+	}
+	return channelStats{
+		metrics: metrics,
+		latency: newLatencyVec(namespace, labels),
+		orphaned: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "orphaned",
+			Help:      "Whether messages are queued but no client is connected",
+		}, labels),
+		stalled: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stalled",
+			Help:      "Whether clients are connected but none is ready to receive messages",
+		}, labels),
+		orphanedSince: newConditionTracker(),
+		stalledSince:  newConditionTracker(),
+		opts:          opts,
+	}
 }
 
-func (cs channelStats) set(s *stats) {
+func (cs channelStats) Set(node string, s *Stats) {
 	for _, topic := range s.Topics {
+		if !cs.opts.topicAllowed(topic) {
+			continue
+		}
 		for _, channel := range topic.Channels {
+			if !cs.opts.channelAllowed(channel) {
+				continue
+			}
 			labels := prometheus.Labels{
+				"nsqd":    node,
 				"topic":   topic.Name,
 				"channel": channel.Name,
-				"paused":  strconv.FormatBool(channel.Paused),
+			}
+			if cs.opts.PausedLabel {
+				labels["paused"] = strconv.FormatBool(channel.Paused)
 			}
 
-			for _, c := range cs {
-				c.vec.With(labels).Set(c.val(channel))
+			for _, c := range cs.metrics {
+				c.vec.set(labels, c.val(channel))
 			}
+			cs.latency.set(labels, &channel.E2eLatency)
+
+			key := node + "\xff" + topic.Name + "\xff" + channel.Name
+			orphaned := cs.orphanedSince.update(key, isOrphaned(channel), s.FetchedAt, cs.opts.OrphanedGracePeriod)
+			stalled := cs.stalledSince.update(key, isStalled(channel), s.FetchedAt, cs.opts.StalledGracePeriod)
+			cs.orphaned.set(labels, boolToFloat(orphaned))
+			cs.stalled.set(labels, boolToFloat(stalled))
+		}
+	}
+}
+
+func isOrphaned(c *Channel) bool {
+	return !c.Paused && len(c.Clients) == 0 && c.Depth > 0
+}
+
+func isStalled(c *Channel) bool {
+	if c.Paused || len(c.Clients) == 0 {
+		return false
+	}
+	for _, client := range c.Clients {
+		if client.ReadyCount > 0 {
+			return false
 		}
 	}
+	return true
+}
+
+func (cs channelStats) keep(node string) {
+	cs.orphanedSince.keep(node)
+	cs.stalledSince.keep(node)
 }
 
-func (cs channelStats) collect(out chan<- prometheus.Metric) {
-	for _, c := range cs {
+func (cs channelStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range cs.metrics {
 		c.vec.Collect(out)
 	}
+	cs.latency.Collect(out)
+	cs.orphaned.Collect(out)
+	cs.stalled.Collect(out)
 }
 
-func (cs channelStats) describe(ch chan<- *prometheus.Desc) {
-	for _, c := range cs {
+func (cs channelStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range cs.metrics {
 		c.vec.Describe(ch)
 	}
+	cs.latency.Describe(ch)
+	cs.orphaned.Describe(ch)
+	cs.stalled.Describe(ch)
 }
 
-func (cs channelStats) reset() {
-	for _, c := range cs {
+func (cs channelStats) Reset() {
+	for _, c := range cs.metrics {
 		c.vec.Reset()
 	}
+	cs.latency.Reset()
+	cs.orphaned.Reset()
+	cs.stalled.Reset()
+	cs.orphanedSince.prune()
+	cs.stalledSince.prune()
 }
@@ -6,129 +6,216 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type clientStats []struct {
-	val func(*client) float64
-	vec *prometheus.GaugeVec
+type clientMetrics []struct {
+	val func(*Client) float64
+	vec statsVec
 }
 
+type clientStats struct {
+	metrics clientMetrics
+	state   statsVec
+	info    statsVec
+	opts    Options
+}
+
+// clientStates are the names of the connection states of nsqd clients,
+// see https://github.com/nsqio/nsq/blob/master/nsqd/client_v2.go
+var clientStates = []string{"init", "disconnected", "connected", "subscribed", "closing"}
+
 // ClientStats creates a new stats collector which is able to
 // expose the client metrics of a nsqd node to Prometheus. The
-// client metrics are reported per topic and per channel.
+// client metrics are reported per topic and per channel. The
+// connection metadata like TLS and compression settings is only
+// exposed by the info metric.
 //
 // If there are too many clients, it could cause a timeout of the
 // Prometheus collection process. So be sure the number of clients
 // is small enough when using this collector.
-func ClientStats(namespace string) StatsCollector {
-	labels := []string{"topic", "channel", "deflate", "snappy", "tls", "client_id", "hostname", "version", "remote_address"}
-	namespace += "_client"
+func ClientStats(opts Options) StatsCollector {
+	labels := []string{"nsqd", "topic", "channel", "client_id", "hostname", "version", "remote_address"}
+	infoLabels := append([]string{
+		"deflate", "snappy", "tls", "user_agent", "tls_version", "tls_cipher_suite",
+		"authed", "auth_identity", "msg_timeout", "output_buffer_size",
+	}, labels...)
+	namespace := opts.Namespace + "_client"
 
-	return clientStats{
+	metrics := clientMetrics{
 		{
-			// TODO: Give state a descriptive name instead of a number.
-			val: func(c *client) float64 { return float64(c.State) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.FinishCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "state",
-				Help:      "State of client",
+				Name:      "finishes_total",
+				Help:      "Total number of finished messages",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.FinishCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.MessageCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "finish_count",
-				Help:      "Finish count",
+				Name:      "messages_total",
+				Help:      "Total number of messages",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.MessageCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "message_count",
-				Help:      "Queue message count",
-			}, labels),
-		},
-		{
-			val: func(c *client) float64 { return float64(c.ReadyCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.ReadyCount) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "ready_count",
 				Help:      "Ready count",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.InFlightCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.InFlightCount) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "in_flight_count",
 				Help:      "In flight count",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.RequeueCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.RequeueCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "requeue_count",
-				Help:      "Requeue count",
+				Name:      "requeues_total",
+				Help:      "Total number of requeued messages",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.ConnectTime) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.ConnectTime) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "connect_ts",
 				Help:      "Connect timestamp",
 			}, labels),
 		},
 		{
-			val: func(c *client) float64 { return float64(c.SampleRate) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(c *Client) float64 { return float64(c.SampleRate) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "sample_rate",
 				Help:      "Sample Rate",
 			}, labels),
 		},
 	}
+	if opts.LegacyCounters {
+		metrics = append(metrics, clientMetrics{
+			{
+				val: func(c *Client) float64 { return float64(c.FinishCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "finish_count",
+					Help:      "Finish count",
+				}, labels),
+			},
+			{
+				val: func(c *Client) float64 { return float64(c.MessageCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "message_count",
+					Help:      "Queue message count",
+				}, labels),
+			},
+			{
+				val: func(c *Client) float64 { return float64(c.RequeueCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "requeue_count",
+					Help:      "Requeue count",
+				}, labels),
+			},
+		}...)
+	}
+	return clientStats{
+		metrics: metrics,
+		state: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "state",
+			Help:      "State of client, 1 for the current state and 0 for the others",
+		}, append(labels, "state")),
+		info: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "info",
+			Help:      "Connection metadata of client, always 1",
+		}, infoLabels),
+		opts: opts,
+	}
 }
 
-func (cs clientStats) set(s *stats) {
+func (cs clientStats) Set(node string, s *Stats) {
 	for _, topic := range s.Topics {
+		if !cs.opts.topicAllowed(topic) {
+			continue
+		}
 		for _, channel := range topic.Channels {
+			if !cs.opts.channelAllowed(channel) {
+				continue
+			}
 			for _, client := range channel.Clients {
+				if !cs.opts.clientAllowed(client) {
+					continue
+				}
 				labels := prometheus.Labels{
+					"nsqd":           node,
 					"topic":          topic.Name,
 					"channel":        channel.Name,
-					"deflate":        strconv.FormatBool(client.Deflate),
-					"snappy":         strconv.FormatBool(client.Snappy),
-					"tls":            strconv.FormatBool(client.TLS),
 					"client_id":      client.ID,
 					"hostname":       client.Hostname,
 					"version":        client.Version,
 					"remote_address": client.RemoteAddress,
 				}
 
-				for _, c := range cs {
-					c.vec.With(labels).Set(c.val(client))
+				for _, c := range cs.metrics {
+					c.vec.set(labels, c.val(client))
+				}
+				for i, state := range clientStates {
+					stateLabels := prometheus.Labels{"state": state}
+					for name, value := range labels {
+						stateLabels[name] = value
+					}
+					cs.state.set(stateLabels, boolToFloat(int(client.State) == i))
+				}
+
+				infoLabels := prometheus.Labels{
+					"deflate":            strconv.FormatBool(client.Deflate),
+					"snappy":             strconv.FormatBool(client.Snappy),
+					"tls":                strconv.FormatBool(client.TLS),
+					"user_agent":         client.UserAgent,
+					"tls_version":        client.TLSVersion,
+					"tls_cipher_suite":   client.TLSCipherSuite,
+					"authed":             strconv.FormatBool(client.Authed),
+					"auth_identity":      client.AuthIdentity,
+					"msg_timeout":        strconv.FormatInt(client.MsgTimeout, 10),
+					"output_buffer_size": strconv.FormatInt(client.OutputBufferSize, 10),
+				}
+				for name, value := range labels {
+					infoLabels[name] = value
 				}
+				cs.info.set(infoLabels, 1)
 			}
 		}
 	}
 }
 
-func (cs clientStats) collect(out chan<- prometheus.Metric) {
-	for _, c := range cs {
+func (cs clientStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range cs.metrics {
 		c.vec.Collect(out)
 	}
+	cs.state.Collect(out)
+	cs.info.Collect(out)
 }
 
-func (cs clientStats) describe(ch chan<- *prometheus.Desc) {
-	for _, c := range cs {
+func (cs clientStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range cs.metrics {
 		c.vec.Describe(ch)
 	}
+	cs.state.Describe(ch)
+	cs.info.Describe(ch)
 }
 
-func (cs clientStats) reset() {
-	for _, c := range cs {
+func (cs clientStats) Reset() {
+	for _, c := range cs.metrics {
 		c.vec.Reset()
 	}
+	cs.state.Reset()
+	cs.info.Reset()
 }
@@ -0,0 +1,203 @@
+package collector
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultClientGroupLabels are the labels clients are grouped by if no
+// other labels are configured.
+var DefaultClientGroupLabels = []string{"topic", "channel", "hostname"}
+
+// clientGroupLabels maps the labels clients can be grouped by to the
+// functions returning the label value of a client.
+var clientGroupLabels = map[string]func(t *Topic, ch *Channel, c *Client) string{
+	"topic":    func(t *Topic, _ *Channel, _ *Client) string { return t.Name },
+	"channel":  func(_ *Topic, ch *Channel, _ *Client) string { return ch.Name },
+	"hostname": func(_ *Topic, _ *Channel, c *Client) string { return c.Hostname },
+	"version":  func(_ *Topic, _ *Channel, c *Client) string { return c.Version },
+	"deflate":  func(_ *Topic, _ *Channel, c *Client) string { return strconv.FormatBool(c.Deflate) },
+	"snappy":   func(_ *Topic, _ *Channel, c *Client) string { return strconv.FormatBool(c.Snappy) },
+	"tls":      func(_ *Topic, _ *Channel, c *Client) string { return strconv.FormatBool(c.TLS) },
+}
+
+type clientGroup struct {
+	labels        prometheus.Labels
+	connections   int
+	readyCount    int64
+	inFlightCount int64
+	finishCount   uint64
+	messageCount  uint64
+	requeueCount  uint64
+}
+
+type clientGroupMetrics []struct {
+	val func(*clientGroup) float64
+	vec statsVec
+}
+
+type clientsByHostStats struct {
+	metrics clientGroupMetrics
+	labels  []string
+	totals  *totalsTracker
+	opts    Options
+}
+
+// ClientsByHostStats creates a new stats collector which is able to
+// expose the client metrics of a nsqd node aggregated by topic, channel
+// and hostname, or by the labels given in the options. In contrast to
+// ClientStats the number of series does not depend on the number of
+// client connections.
+//
+// The totals of a group include the last totals of the connections closed
+// since the group has been seen first, so they do not decrease when a
+// consumer reconnects.
+func ClientsByHostStats(opts Options) StatsCollector {
+	labels := opts.ClientGroupLabels
+	if len(labels) == 0 {
+		labels = DefaultClientGroupLabels
+	}
+	vecLabels := append([]string{"nsqd"}, labels...)
+	namespace := opts.Namespace + "_clients"
+
+	return &clientsByHostStats{
+		metrics: clientGroupMetrics{
+			{
+				val: func(g *clientGroup) float64 { return float64(g.connections) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "connection_count",
+					Help:      "Number of client connections",
+				}, vecLabels),
+			},
+			{
+				val: func(g *clientGroup) float64 { return float64(g.readyCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "ready_count",
+					Help:      "Ready count summed over all connections",
+				}, vecLabels),
+			},
+			{
+				val: func(g *clientGroup) float64 { return float64(g.inFlightCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "in_flight_count",
+					Help:      "In flight count summed over all connections",
+				}, vecLabels),
+			},
+			{
+				val: func(g *clientGroup) float64 { return float64(g.finishCount) },
+				vec: newCounterVec(prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "finishes_total",
+					Help:      "Total number of finished messages of all connections",
+				}, vecLabels),
+			},
+			{
+				val: func(g *clientGroup) float64 { return float64(g.messageCount) },
+				vec: newCounterVec(prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "messages_total",
+					Help:      "Total number of messages of all connections",
+				}, vecLabels),
+			},
+			{
+				val: func(g *clientGroup) float64 { return float64(g.requeueCount) },
+				vec: newCounterVec(prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "requeues_total",
+					Help:      "Total number of requeued messages of all connections",
+				}, vecLabels),
+			},
+		},
+		labels: labels,
+		totals: newTotalsTracker(),
+		opts:   opts,
+	}
+}
+
+func (cs *clientsByHostStats) Set(node string, s *Stats) {
+	groups := make(map[string]*clientGroup)
+	conns := make(map[string]connTotals)
+	for _, topic := range s.Topics {
+		if !cs.opts.topicAllowed(topic) {
+			continue
+		}
+		for _, channel := range topic.Channels {
+			if !cs.opts.channelAllowed(channel) {
+				continue
+			}
+			for _, client := range channel.Clients {
+				if !cs.opts.clientAllowed(client) {
+					continue
+				}
+
+				values := make([]string, len(cs.labels))
+				for i, name := range cs.labels {
+					values[i] = clientGroupLabels[name](topic, channel, client)
+				}
+				key := strings.Join(values, "\xff")
+
+				g, has := groups[key]
+				if !has {
+					g = &clientGroup{labels: prometheus.Labels{"nsqd": node}}
+					for i, name := range cs.labels {
+						g.labels[name] = values[i]
+					}
+					groups[key] = g
+				}
+				g.connections++
+				g.readyCount += client.ReadyCount
+				g.inFlightCount += client.InFlightCount
+				g.finishCount += client.FinishCount
+				g.messageCount += client.MessageCount
+				g.requeueCount += client.RequeueCount
+				conns[connKey(client, topic.Name, channel.Name)] = connTotals{
+					group:  key,
+					totals: []uint64{client.FinishCount, client.MessageCount, client.RequeueCount},
+				}
+			}
+		}
+	}
+
+	for key, totals := range cs.totals.update(node, s.FetchedAt, conns) {
+		g, has := groups[key]
+		if !has {
+			continue
+		}
+		g.finishCount += totals[0]
+		g.messageCount += totals[1]
+		g.requeueCount += totals[2]
+	}
+	for _, g := range groups {
+		for _, c := range cs.metrics {
+			c.vec.set(g.labels, c.val(g))
+		}
+	}
+}
+
+func (cs *clientsByHostStats) keep(node string) {
+	cs.totals.keep(node)
+}
+
+func (cs *clientsByHostStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range cs.metrics {
+		c.vec.Collect(out)
+	}
+}
+
+func (cs *clientsByHostStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range cs.metrics {
+		c.vec.Describe(ch)
+	}
+}
+
+func (cs *clientsByHostStats) Reset() {
+	for _, c := range cs.metrics {
+		c.vec.Reset()
+	}
+	cs.totals.prune()
+}
@@ -0,0 +1,156 @@
+package collector
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type memoryMetrics []struct {
+	val func(*MemStats) float64
+	vec statsVec
+}
+
+type memoryStats struct {
+	metrics memoryMetrics
+	gcPause *gcPauseVec
+}
+
+// gcPauseVec exposes the percentiles of the recent GC pauses reported by
+// nsqd as summaries. nsqd does not report the sum or the count of the
+// pauses, so the sum of the summaries is NaN and the count is zero.
+type gcPauseVec struct {
+	desc    *prometheus.Desc
+	metrics []prometheus.Metric
+}
+
+func (v *gcPauseVec) set(node string, m *MemStats) {
+	// nsqd reports the pauses in microseconds
+	quantiles := map[float64]float64{
+		0.95: float64(m.GCPauseUsec95) / 1e6,
+		0.99: float64(m.GCPauseUsec99) / 1e6,
+		1:    float64(m.GCPauseUsec100) / 1e6,
+	}
+	v.metrics = append(v.metrics, prometheus.MustNewConstSummary(v.desc, 0, math.NaN(), quantiles, node))
+}
+
+func (v *gcPauseVec) Collect(out chan<- prometheus.Metric) {
+	for _, m := range v.metrics {
+		out <- m
+	}
+}
+
+func (v *gcPauseVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *gcPauseVec) Reset() {
+	v.metrics = nil
+}
+
+// MemoryStats creates a new stats collector which is able to expose the
+// Go runtime memory statistics of a nsqd node to Prometheus. nsqd only
+// reports them on request, so the executor asks for them as soon as this
+// collector is used.
+func MemoryStats(opts Options) StatsCollector {
+	labels := []string{"nsqd"}
+	namespace := opts.Namespace + "_memory"
+
+	return memoryStats{
+		metrics: memoryMetrics{
+			{
+				val: func(m *MemStats) float64 { return float64(m.HeapObjects) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "heap_objects",
+					Help:      "Number of allocated heap objects",
+				}, labels),
+			},
+			{
+				val: func(m *MemStats) float64 { return float64(m.HeapIdleBytes) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "heap_idle_bytes",
+					Help:      "Bytes in idle heap spans",
+				}, labels),
+			},
+			{
+				val: func(m *MemStats) float64 { return float64(m.HeapInUseBytes) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "heap_in_use_bytes",
+					Help:      "Bytes in in-use heap spans",
+				}, labels),
+			},
+			{
+				val: func(m *MemStats) float64 { return float64(m.HeapReleasedBytes) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "heap_released_bytes",
+					Help:      "Bytes of heap memory returned to the OS",
+				}, labels),
+			},
+			{
+				val: func(m *MemStats) float64 { return float64(m.NextGCBytes) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "next_gc_bytes",
+					Help:      "Heap size at which the next GC cycle starts",
+				}, labels),
+			},
+			{
+				val: func(m *MemStats) float64 { return float64(m.GCTotalRuns) },
+				vec: newCounterVec(prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "gc_runs_total",
+					Help:      "Total number of completed GC cycles",
+				}, labels),
+			},
+		},
+		gcPause: &gcPauseVec{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "", "gc_pause_seconds"),
+				"Percentiles of the recent GC pauses, sum and count are not reported",
+				labels, nil,
+			),
+		},
+	}
+}
+
+// NeedsMemory makes the executor request the memory stats from nsqd.
+func (ms memoryStats) NeedsMemory() bool {
+	return true
+}
+
+func (ms memoryStats) Set(node string, s *Stats) {
+	m := s.Memory
+	if m == nil {
+		return
+	}
+	labels := prometheus.Labels{"nsqd": node}
+	for _, c := range ms.metrics {
+		c.vec.set(labels, c.val(m))
+	}
+	ms.gcPause.set(node, m)
+}
+
+func (ms memoryStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range ms.metrics {
+		c.vec.Collect(out)
+	}
+	ms.gcPause.Collect(out)
+}
+
+func (ms memoryStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range ms.metrics {
+		c.vec.Describe(ch)
+	}
+	ms.gcPause.Describe(ch)
+}
+
+func (ms memoryStats) Reset() {
+	for _, c := range ms.metrics {
+		c.vec.Reset()
+	}
+	ms.gcPause.Reset()
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type nodeStats struct {
+	info       statsVec
+	healthOK   statsVec
+	health     statsVec
+	startTime  statsVec
+	nodeInfo   statsVec
+	maxMsgSize statsVec
+}
+
+// NodeStats creates a new stats collector which is able to expose the
+// version, health and start time of a nsqd node as well as its addresses
+// and maximum message size. The latter are requested from nsqd as soon as
+// this collector is used.
+func NodeStats(opts Options) StatsCollector {
+	namespace := opts.Namespace
+
+	return nodeStats{
+		info: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "info",
+			Help:      "Version of the nsqd node, always 1",
+		}, []string{"nsqd", "version"}),
+		healthOK: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "health_ok",
+			Help:      "Whether the nsqd node reports itself healthy",
+		}, []string{"nsqd"}),
+		health: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "health_info",
+			Help:      "Health message of the nsqd node, always 1",
+		}, []string{"nsqd", "message"}),
+		startTime: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "start_time_seconds",
+			Help:      "Start time of the nsqd node since unix epoch in seconds",
+		}, []string{"nsqd"}),
+		nodeInfo: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_info",
+			Help:      "Addresses of the nsqd node, always 1",
+		}, []string{"nsqd", "broadcast_address", "hostname", "tcp_port", "http_port"}),
+		maxMsgSize: newGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "max_msg_size_bytes",
+			Help:      "Maximum size of a single message accepted by the nsqd node",
+		}, []string{"nsqd"}),
+	}
+}
+
+// NeedsInfo makes the executor fetch the node info from nsqd.
+func (ns nodeStats) NeedsInfo() bool {
+	return true
+}
+
+func (ns nodeStats) Set(node string, s *Stats) {
+	labels := prometheus.Labels{"nsqd": node}
+
+	ns.info.set(prometheus.Labels{"nsqd": node, "version": s.Version}, 1)
+	ns.health.set(prometheus.Labels{"nsqd": node, "message": s.Health}, 1)
+	if s.Health == "OK" {
+		ns.healthOK.set(labels, 1)
+	} else {
+		ns.healthOK.set(labels, 0)
+	}
+	ns.startTime.set(labels, float64(s.StartTime))
+
+	if s.Info == nil {
+		return
+	}
+	ns.nodeInfo.set(prometheus.Labels{
+		"nsqd":              node,
+		"broadcast_address": s.Info.BroadcastAddress,
+		"hostname":          s.Info.Hostname,
+		"tcp_port":          strconv.Itoa(s.Info.TCPPort),
+		"http_port":         strconv.Itoa(s.Info.HTTPPort),
+	}, 1)
+	if s.Info.MaxMsgSize > 0 {
+		ns.maxMsgSize.set(labels, float64(s.Info.MaxMsgSize))
+	}
+}
+
+func (ns nodeStats) vecs() []statsVec {
+	return []statsVec{ns.info, ns.healthOK, ns.health, ns.startTime, ns.nodeInfo, ns.maxMsgSize}
+}
+
+func (ns nodeStats) Collect(out chan<- prometheus.Metric) {
+	for _, v := range ns.vecs() {
+		v.Collect(out)
+	}
+}
+
+func (ns nodeStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range ns.vecs() {
+		v.Describe(ch)
+	}
+}
+
+func (ns nodeStats) Reset() {
+	for _, v := range ns.vecs() {
+		v.Reset()
+	}
+}
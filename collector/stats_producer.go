@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type producerGroup struct {
+	labels       prometheus.Labels
+	connections  int
+	messageCount uint64
+}
+
+type producerMetrics []struct {
+	val func(*producerGroup) float64
+	vec statsVec
+}
+
+type producerStats struct {
+	metrics producerMetrics
+	totals  *totalsTracker
+	opts    Options
+}
+
+// ProducerStats creates a new stats collector which is able to expose
+// the messages published to the topics of a nsqd node. The producer
+// connections are grouped by topic and hostname, or by topic only if
+// AggregateProducerHosts is set. Only nsqd >= 1.0 reports its producers.
+//
+// The message totals of a group include the last totals of the
+// connections closed since the group has been seen first, so they do not
+// decrease when a producer reconnects.
+func ProducerStats(opts Options) StatsCollector {
+	labels := []string{"nsqd", "topic"}
+	if !opts.AggregateProducerHosts {
+		labels = append(labels, "hostname")
+	}
+	namespace := opts.Namespace + "_producer"
+
+	return &producerStats{
+		metrics: producerMetrics{
+			{
+				val: func(g *producerGroup) float64 { return float64(g.connections) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "connection_count",
+					Help:      "Number of producer connections which published to the topic",
+				}, labels),
+			},
+			{
+				val: func(g *producerGroup) float64 { return float64(g.messageCount) },
+				vec: newCounterVec(prometheus.CounterOpts{
+					Namespace: namespace,
+					Name:      "messages_total",
+					Help:      "Total number of messages published to the topic",
+				}, labels),
+			},
+		},
+		totals: newTotalsTracker(),
+		opts:   opts,
+	}
+}
+
+func (ps *producerStats) Set(node string, s *Stats) {
+	groups := make(map[string]*producerGroup)
+	conns := make(map[string]connTotals)
+	for _, p := range s.Producers {
+		if !ps.opts.clientAllowed(p) {
+			continue
+		}
+		for _, pc := range p.PubCounts {
+			if !ps.opts.topicAllowed(&Topic{Name: pc.Topic}) {
+				continue
+			}
+
+			key := pc.Topic
+			labels := prometheus.Labels{"nsqd": node, "topic": pc.Topic}
+			if !ps.opts.AggregateProducerHosts {
+				key += "\xff" + p.Hostname
+				labels["hostname"] = p.Hostname
+			}
+
+			g, has := groups[key]
+			if !has {
+				g = &producerGroup{labels: labels}
+				groups[key] = g
+			}
+			g.connections++
+			g.messageCount += pc.Count
+			conns[connKey(p, pc.Topic)] = connTotals{group: key, totals: []uint64{pc.Count}}
+		}
+	}
+
+	for key, totals := range ps.totals.update(node, s.FetchedAt, conns) {
+		if g, has := groups[key]; has {
+			g.messageCount += totals[0]
+		}
+	}
+	for _, g := range groups {
+		for _, c := range ps.metrics {
+			c.vec.set(g.labels, c.val(g))
+		}
+	}
+}
+
+func (ps *producerStats) keep(node string) {
+	ps.totals.keep(node)
+}
+
+func (ps *producerStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range ps.metrics {
+		c.vec.Collect(out)
+	}
+}
+
+func (ps *producerStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range ps.metrics {
+		c.vec.Describe(ch)
+	}
+}
+
+func (ps *producerStats) Reset() {
+	for _, c := range ps.metrics {
+		c.vec.Reset()
+	}
+	ps.totals.prune()
+}
@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetNsqdStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		version string
+		reason  string
+	}{
+		{
+			name:    "envelope",
+			status:  http.StatusOK,
+			body:    `{"status_code":200,"status_txt":"OK","data":{"version":"0.3.8","health":"OK"}}`,
+			version: "0.3.8",
+		},
+		{
+			name:    "unwrapped",
+			status:  http.StatusOK,
+			body:    `{"version":"1.2.0","health":"OK"}`,
+			version: "1.2.0",
+		},
+		{
+			name:   "http status",
+			status: http.StatusInternalServerError,
+			body:   `{"message":"INTERNAL_ERROR"}`,
+			reason: reasonHTTPStatus,
+		},
+		{
+			name:   "envelope error without data",
+			status: http.StatusOK,
+			body:   `{"status_code":500,"status_txt":"INTERNAL_ERROR","data":null}`,
+			reason: reasonNsqdStatusCode,
+		},
+		{
+			name:   "envelope without data",
+			status: http.StatusOK,
+			body:   `{"status_code":200,"status_txt":"OK","data":null}`,
+			reason: reasonDecode,
+		},
+		{
+			name:   "invalid json",
+			status: http.StatusOK,
+			body:   `{"version":`,
+			reason: reasonDecode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			s, err := getNsqdStats(context.Background(), srv.Client(), srv.URL+"/stats?format=json")
+			if tt.reason != "" {
+				serr, ok := err.(*scrapeError)
+				if !ok {
+					t.Fatalf("expected scrape error, got %v", err)
+				}
+				if serr.reason != tt.reason {
+					t.Errorf("expected reason %q, got %q (%v)", tt.reason, serr.reason, serr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s.Version != tt.version {
+				t.Errorf("expected version %q, got %q", tt.version, s.Version)
+			}
+		})
+	}
+}
+
+func TestGetNsqdStatsStatusText(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status_code":500,"status_txt":"INTERNAL_ERROR","data":null}`))
+	}))
+	defer srv.Close()
+
+	_, err := getNsqdStats(context.Background(), srv.Client(), srv.URL+"/stats")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if want := "nsqd_status_code: unexpected nsqd status code 500: INTERNAL_ERROR"; err.Error() != want {
+		t.Errorf("expected error %q, got %q", want, err.Error())
+	}
+}
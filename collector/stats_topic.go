@@ -6,95 +6,124 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type topicStats []struct {
-	val func(*topic) float64
-	vec *prometheus.GaugeVec
+type topicMetrics []struct {
+	val func(*Topic) float64
+	vec statsVec
+}
+
+type topicStats struct {
+	metrics topicMetrics
+	latency *latencyVec
+	opts    Options
 }
 
 // TopicStats creates a new stats collector which is able to
 // expose the topic metrics of a nsqd node to Prometheus.
-func TopicStats(namespace string) StatsCollector {
-	labels := []string{"topic", "paused"}
-	namespace += "_topic"
+func TopicStats(opts Options) StatsCollector {
+	labels := []string{"nsqd", "topic"}
+	if opts.PausedLabel {
+		labels = append(labels, "paused")
+	}
+	namespace := opts.Namespace + "_topic"
 
-	return topicStats{
+	metrics := topicMetrics{
 		{
-			val: func(t *topic) float64 { return float64(len(t.Channels)) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(t *Topic) float64 { return float64(len(t.Channels)) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "channel_count",
 				Help:      "Number of channels",
 			}, labels),
 		},
 		{
-			val: func(t *topic) float64 { return float64(t.Depth) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(t *Topic) float64 { return float64(t.Depth) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "depth",
 				Help:      "Queue depth",
 			}, labels),
 		},
 		{
-			val: func(t *topic) float64 { return float64(t.BackendDepth) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(t *Topic) float64 { return float64(t.BackendDepth) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
 				Name:      "backend_depth",
 				Help:      "Queue backend depth",
 			}, labels),
 		},
 		{
-			val: func(t *topic) float64 { return getPercentile(t, 99) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "e2e_latency_99_percentile",
-				Help:      "Queue e2e latency 99th percentile",
-			}, labels),
-		},
-		{
-			val: func(t *topic) float64 { return getPercentile(t, 95) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(t *Topic) float64 { return float64(t.MessageCount) },
+			vec: newCounterVec(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "e2e_latency_95_percentile",
-				Help:      "Queue e2e latency 95th percentile",
+				Name:      "messages_total",
+				Help:      "Total number of messages",
 			}, labels),
 		},
 		{
-			val: func(t *topic) float64 { return float64(t.MessageCount) },
-			vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			val: func(t *Topic) float64 { return boolToFloat(t.Paused) },
+			vec: newGaugeVec(prometheus.GaugeOpts{
 				Namespace: namespace,
-				Name:      "message_count",
-				Help:      "Queue message count",
+				Name:      "paused",
+				Help:      "Whether the topic is paused",
 			}, labels),
 		},
 	}
+	if opts.LegacyCounters {
+		metrics = append(metrics, topicMetrics{
+			{
+				val: func(t *Topic) float64 { return float64(t.MessageCount) },
+				vec: newGaugeVec(prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "message_count",
+					Help:      "Queue message count",
+				}, labels),
+			},
+		}...)
+	}
+	return topicStats{
+		metrics: metrics,
+		latency: newLatencyVec(namespace, labels),
+		opts:    opts,
+	}
 }
 
-func (ts topicStats) set(s *stats) {
+func (ts topicStats) Set(node string, s *Stats) {
 	for _, topic := range s.Topics {
+		if !ts.opts.topicAllowed(topic) {
+			continue
+		}
 		labels := prometheus.Labels{
-			"topic":  topic.Name,
-			"paused": strconv.FormatBool(topic.Paused),
+			"nsqd":  node,
+			"topic": topic.Name,
+		}
+		if ts.opts.PausedLabel {
+			labels["paused"] = strconv.FormatBool(topic.Paused)
 		}
 
-		for _, c := range ts {
-			c.vec.With(labels).Set(c.val(topic))
+		for _, c := range ts.metrics {
+			c.vec.set(labels, c.val(topic))
 		}
+		ts.latency.set(labels, &topic.E2eLatency)
 	}
 }
-func (ts topicStats) collect(out chan<- prometheus.Metric) {
-	for _, c := range ts {
+
+func (ts topicStats) Collect(out chan<- prometheus.Metric) {
+	for _, c := range ts.metrics {
 		c.vec.Collect(out)
 	}
+	ts.latency.Collect(out)
 }
 
-func (ts topicStats) describe(ch chan<- *prometheus.Desc) {
-	for _, c := range ts {
+func (ts topicStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range ts.metrics {
 		c.vec.Describe(ch)
 	}
+	ts.latency.Describe(ch)
 }
 
-func (ts topicStats) reset() {
-	for _, c := range ts {
+func (ts topicStats) Reset() {
+	for _, c := range ts.metrics {
 		c.vec.Reset()
 	}
+	ts.latency.Reset()
 }
@@ -0,0 +1,152 @@
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures the TLS connections to nsqd. All settings are
+// optional and independent of each other. The certificate files are read
+// again whenever they change, so rotated certificates are picked up by
+// new connections.
+type TLSConfig struct {
+	// CACert is the CA certificate file used to verify nsqd. If empty,
+	// the system CA certificates are used.
+	CACert string
+	// Cert and Key are the files of the client certificate.
+	Cert string
+	Key  string
+	// InsecureSkipVerify disables the verification of the nsqd
+	// certificate.
+	InsecureSkipVerify bool
+	// ServerName overrides the name the nsqd certificate is verified
+	// against, which defaults to the host of the nsqd address.
+	ServerName string
+}
+
+func (c TLSConfig) isZero() bool {
+	return c == TLSConfig{}
+}
+
+func newHTTPClient(c TLSConfig) (*http.Client, error) {
+	transport := &http.Transport{}
+	if !c.isZero() {
+		l := &tlsLoader{config: c}
+		// load the files once to fail early on invalid configurations
+		if _, err := l.tlsConfig(); err != nil {
+			return nil, err
+		}
+		transport.DialTLSContext = l.dial
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// tlsLoader builds the TLS configuration of the connections to nsqd and
+// rebuilds it whenever one of the certificate files has been modified.
+type tlsLoader struct {
+	config TLSConfig
+
+	mutex   sync.Mutex
+	modTime map[string]time.Time
+	cached  *tls.Config
+}
+
+// dial connects to nsqd. The connection attempt and the handshake are
+// canceled when ctx is done, e.g. when the scrape timeout expires.
+func (l *tlsLoader) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	cfg, err := l.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 30 * time.Second},
+		Config:    cfg,
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// tlsConfig returns a copy of the current TLS configuration.
+func (l *tlsLoader) tlsConfig() (*tls.Config, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	modTime := make(map[string]time.Time)
+	for _, file := range []string{l.config.CACert, l.config.Cert, l.config.Key} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTime[file] = info.ModTime()
+	}
+
+	if l.cached == nil || !sameModTimes(l.modTime, modTime) {
+		cfg, err := l.load()
+		if err != nil {
+			return nil, err
+		}
+		l.cached, l.modTime = cfg, modTime
+	}
+	return l.cached.Clone(), nil
+}
+
+func (l *tlsLoader) load() (*tls.Config, error) {
+	c := l.config
+	cfg := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, errors.New("TLS certificate and key must be given together")
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CACert != "" {
+		caCert, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+	return cfg, nil
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, t := range a {
+		if !t.Equal(b[file]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"1.2.0","health":"OK"}`))
+	}))
+	defer srv.Close()
+
+	client, err := newHTTPClient(TLSConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getNsqdStats(context.Background(), client, srv.URL+"/stats"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTLSHandshakeCanceled(t *testing.T) {
+	// accept connections but never answer the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	l := &tlsLoader{config: TLSConfig{InsecureSkipVerify: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err = l.dial(ctx, "tcp", ln.Addr().String()); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("handshake not canceled, took %v", elapsed)
+	}
+}
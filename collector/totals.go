@@ -0,0 +1,108 @@
+package collector
+
+import (
+	"strconv"
+	"time"
+)
+
+// totalsTracker keeps the last totals of closed connections, so totals
+// summed up over the connections of a group do not decrease when a
+// connection is closed. The totals of a group are dropped once the group
+// has no connections anymore, which starts a new series when a connection
+// of the group is opened again. Nodes which have been neither updated nor
+// kept between two prunes are forgotten.
+type totalsTracker struct {
+	nodes map[string]*nodeTotals
+}
+
+type nodeTotals struct {
+	fetchedAt time.Time
+	conns     map[string]connTotals
+	closed    map[string][]uint64
+	seen      bool
+}
+
+// connTotals are the totals of a single connection and the key of the
+// group the connection belongs to.
+type connTotals struct {
+	group  string
+	totals []uint64
+}
+
+func newTotalsTracker() *totalsTracker {
+	return &totalsTracker{nodes: make(map[string]*nodeTotals)}
+}
+
+// connKey identifies a connection of a client to nsqd. The client ID is
+// not unique, as it defaults to the short hostname of the client.
+func connKey(c *Client, parts ...string) string {
+	key := c.ID + "\xff" + c.RemoteAddress + "\xff" + strconv.FormatInt(c.ConnectTime, 10)
+	for _, p := range parts {
+		key += "\xff" + p
+	}
+	return key
+}
+
+// update stores the totals of the current connections of the node and
+// returns the summed up totals of its closed connections per group. Stats
+// which have already been seen, e.g. when they are served from a poll
+// snapshot, do not change the state.
+func (t *totalsTracker) update(node string, fetchedAt time.Time, conns map[string]connTotals) map[string][]uint64 {
+	prev, has := t.nodes[node]
+	if has && !fetchedAt.After(prev.fetchedAt) {
+		prev.seen = true
+		return prev.closed
+	}
+
+	nt := &nodeTotals{
+		fetchedAt: fetchedAt,
+		conns:     conns,
+		closed:    make(map[string][]uint64),
+		seen:      true,
+	}
+	groups := make(map[string]bool, len(conns))
+	for _, c := range conns {
+		groups[c.group] = true
+	}
+	if has {
+		for group, totals := range prev.closed {
+			if groups[group] {
+				nt.closed[group] = totals
+			}
+		}
+		for key, c := range prev.conns {
+			if _, open := conns[key]; open || !groups[c.group] {
+				continue
+			}
+			closed, has := nt.closed[c.group]
+			if !has {
+				closed = make([]uint64, len(c.totals))
+			} else {
+				// do not modify the totals of the previous state
+				closed = append([]uint64(nil), closed...)
+			}
+			for i, v := range c.totals {
+				closed[i] += v
+			}
+			nt.closed[c.group] = closed
+		}
+	}
+	t.nodes[node] = nt
+	return nt.closed
+}
+
+// keep keeps the state of a node which could not be scraped.
+func (t *totalsTracker) keep(node string) {
+	if nt, has := t.nodes[node]; has {
+		nt.seen = true
+	}
+}
+
+func (t *totalsTracker) prune() {
+	for node, nt := range t.nodes {
+		if !nt.seen {
+			delete(t.nodes, node)
+		}
+		nt.seen = false
+	}
+}
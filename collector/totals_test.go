@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTotalsTracker(t *testing.T) {
+	tr := newTotalsTracker()
+	start := time.Now()
+	steps := []struct {
+		conns  map[string]connTotals
+		closed map[string][]uint64
+	}{
+		{
+			conns: map[string]connTotals{
+				"a1": {group: "a", totals: []uint64{10}},
+				"a2": {group: "a", totals: []uint64{5}},
+				"b1": {group: "b", totals: []uint64{7}},
+			},
+			closed: map[string][]uint64{},
+		},
+		{
+			// a2 reconnected as a3, b1 closed without another connection
+			conns: map[string]connTotals{
+				"a1": {group: "a", totals: []uint64{12}},
+				"a3": {group: "a", totals: []uint64{1}},
+			},
+			closed: map[string][]uint64{"a": {5}},
+		},
+		{
+			// a1 closed as well, the totals of a2 are kept
+			conns: map[string]connTotals{
+				"a3": {group: "a", totals: []uint64{3}},
+			},
+			closed: map[string][]uint64{"a": {17}},
+		},
+		{
+			// b reappears without the totals of b1
+			conns: map[string]connTotals{
+				"a3": {group: "a", totals: []uint64{4}},
+				"b2": {group: "b", totals: []uint64{1}},
+			},
+			closed: map[string][]uint64{"a": {17}},
+		},
+	}
+
+	for i, step := range steps {
+		fetchedAt := start.Add(time.Duration(i) * time.Second)
+		closed := tr.update("n", fetchedAt, step.conns)
+		if !reflect.DeepEqual(closed, step.closed) {
+			t.Errorf("step %d: expected closed totals %v, got %v", i, step.closed, closed)
+		}
+		// the same stats again, e.g. from a poll snapshot
+		if again := tr.update("n", fetchedAt, step.conns); !reflect.DeepEqual(again, step.closed) {
+			t.Errorf("step %d: expected unchanged totals %v, got %v", i, step.closed, again)
+		}
+		tr.prune()
+	}
+
+	tr.prune()
+	if len(tr.nodes) != 0 {
+		t.Errorf("expected node to be pruned, got %v", tr.nodes)
+	}
+}
+
+func TestTotalsTrackerFailedScrape(t *testing.T) {
+	tr := newTotalsTracker()
+	start := time.Now()
+	tr.update("n", start, map[string]connTotals{
+		"a1": {group: "a", totals: []uint64{10}},
+		"a2": {group: "a", totals: []uint64{5}},
+	})
+	tr.prune()
+
+	// the scrape of n failed, its state is kept
+	tr.keep("n")
+	tr.prune()
+
+	closed := tr.update("n", start.Add(2*time.Second), map[string]connTotals{
+		"a1": {group: "a", totals: []uint64{12}},
+	})
+	if want := map[string][]uint64{"a": {5}}; !reflect.DeepEqual(closed, want) {
+		t.Errorf("expected closed totals %v, got %v", want, closed)
+	}
+	tr.prune()
+
+	// n is gone
+	tr.prune()
+	if len(tr.nodes) != 0 {
+		t.Errorf("expected node to be pruned, got %v", tr.nodes)
+	}
+}
+
+func TestProducerStatsFailedScrape(t *testing.T) {
+	c := ProducerStats(Options{Namespace: "nsq"})
+	start := time.Now()
+	producer := func(id string, count uint64) *Client {
+		return &Client{
+			ID:            id,
+			Hostname:      "host",
+			RemoteAddress: id + ":4150",
+			PubCounts:     []*PubCount{{Topic: "t", Count: count}},
+		}
+	}
+	const total = `nsq_producer_messages_total{hostname="host",nsqd="n",topic="t"}`
+
+	c.Reset()
+	c.Set("n", &Stats{FetchedAt: start, Producers: []*Client{producer("a", 10), producer("b", 5)}})
+	if v := collectValues(c)[total]; v != 15 {
+		t.Errorf("expected %v, got %v", 15, v)
+	}
+
+	// the scrape of n failed
+	c.Reset()
+	c.(nodeKeeper).keep("n")
+
+	// b reconnected as c
+	c.Reset()
+	c.Set("n", &Stats{FetchedAt: start.Add(2 * time.Second), Producers: []*Client{producer("a", 12), producer("c", 1)}})
+	if v := collectValues(c)[total]; v != 18 {
+		t.Errorf("expected %v, got %v", 18, v)
+	}
+}
+
+var fqNameRegexp = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+// collectValues returns the values of the metrics of a collector by name
+// and labels in the exposition format.
+func collectValues(c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	values := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			panic(err)
+		}
+		labels := make([]string, 0, len(pb.Label))
+		for _, l := range pb.Label {
+			labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+		}
+		sort.Strings(labels)
+		key := fqNameRegexp.FindStringSubmatch(m.Desc().String())[1] + "{" + strings.Join(labels, ",") + "}"
+		switch {
+		case pb.Gauge != nil:
+			values[key] = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			values[key] = pb.Counter.GetValue()
+		case pb.Untyped != nil:
+			values[key] = pb.Untyped.GetValue()
+		}
+	}
+	return values
+}
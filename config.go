@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lovoo/nsq_exporter/collector"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config describes what the exporter scrapes and how the metrics are
+// exposed. It is either read from a YAML file or built from the command
+// line flags.
+type config struct {
+	Namespace    string         `yaml:"namespace"`
+	Targets      []targetConfig `yaml:"targets"`
+	Lookupd      []string       `yaml:"nsqlookupd"`
+	Concurrency  int            `yaml:"concurrency"`
+	PollInterval time.Duration  `yaml:"poll_interval"`
+
+	Timeout       time.Duration `yaml:"timeout"`
+	TimeoutOffset time.Duration `yaml:"timeout_offset"`
+	Retries       int           `yaml:"retries"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff"`
+
+	TLS        tlsConfig     `yaml:"tls"`
+	Collectors []string      `yaml:"collectors"`
+	Filters    filtersConfig `yaml:"filters"`
+	Canary     canaryConfig  `yaml:"canary"`
+
+	ClientGroupLabels      []string `yaml:"client_group_labels"`
+	AggregateProducerHosts bool     `yaml:"aggregate_producer_hosts"`
+	LegacyCounters         bool     `yaml:"legacy_counter_gauges"`
+	LegacyPausedLabel      bool     `yaml:"legacy_paused_label"`
+
+	OrphanedGracePeriod time.Duration `yaml:"orphaned_grace_period"`
+	StalledGracePeriod  time.Duration `yaml:"stalled_grace_period"`
+}
+
+type targetConfig struct {
+	Address string        `yaml:"address"`
+	TLS     *tlsConfig    `yaml:"tls"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type tlsConfig struct {
+	CACert             string `yaml:"ca_cert"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
+}
+
+type canaryConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Topic    string        `yaml:"topic"`
+	Channel  string        `yaml:"channel"`
+}
+
+type filtersConfig struct {
+	Topics        filterConfig `yaml:"topics"`
+	Channels      filterConfig `yaml:"channels"`
+	Clients       filterConfig `yaml:"clients"`
+	SkipEphemeral bool         `yaml:"skip_ephemeral"`
+}
+
+type filterConfig struct {
+	Include string `yaml:"include"`
+	Exclude string `yaml:"exclude"`
+}
+
+// configFromFlags builds the configuration from the command line flags.
+func configFromFlags() *config {
+	c := &config{
+		Namespace:     *namespace,
+		Lookupd:       lookupdURLs,
+		Concurrency:   *nsqdConcurrency,
+		PollInterval:  *pollInterval,
+		Timeout:       *nsqdTimeout,
+		TimeoutOffset: *timeoutOffset,
+		Retries:       *nsqdRetries,
+		RetryBackoff:  *retryBackoff,
+		TLS: tlsConfig{
+			CACert:             *tlsCACert,
+			Cert:               *tlsCert,
+			Key:                *tlsKey,
+			InsecureSkipVerify: *tlsInsecure,
+			ServerName:         *tlsServerName,
+		},
+		Collectors: splitList(*enabledCollectors),
+		Canary: canaryConfig{
+			Interval: *canaryInterval,
+			Timeout:  *canaryTimeout,
+			Topic:    *canaryTopic,
+			Channel:  *canaryChannel,
+		},
+		Filters: filtersConfig{
+			Topics:        filterConfig{Include: *topicInclude, Exclude: *topicExclude},
+			Channels:      filterConfig{Include: *channelInclude, Exclude: *channelExclude},
+			Clients:       filterConfig{Include: *clientInclude, Exclude: *clientExclude},
+			SkipEphemeral: *skipEphemeral,
+		},
+		ClientGroupLabels:      splitList(*clientGroupLabels),
+		AggregateProducerHosts: *aggregateHosts,
+		LegacyCounters:         *legacyCounters,
+		LegacyPausedLabel:      *pausedLabel,
+		OrphanedGracePeriod:    *orphanedGrace,
+		StalledGracePeriod:     *stalledGrace,
+	}
+
+	// The default nsqd address is only scraped if no nsqlookupd is used
+	// for discovering the nsqd nodes.
+	if len(lookupdURLs) == 0 || isFlagSet("nsqd.addr") {
+		for _, addr := range splitList(*nsqdURL) {
+			c.Targets = append(c.Targets, targetConfig{Address: addr})
+		}
+	}
+	return c
+}
+
+// loadConfig reads the configuration from the given YAML file. Settings
+// missing in the file default to the defaults of the command line flags.
+func loadConfig(filename string) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &config{
+		Namespace:         "nsq",
+		Concurrency:       8,
+		Timeout:           10 * time.Second,
+		TimeoutOffset:     500 * time.Millisecond,
+		RetryBackoff:      100 * time.Millisecond,
+		Collectors:        []string{"stats.topics", "stats.channels"},
+		ClientGroupLabels: collector.DefaultClientGroupLabels,
+		Canary: canaryConfig{
+			Timeout: 5 * time.Second,
+			Topic:   defaultCanaryTopic,
+			Channel: defaultCanaryChannel,
+		},
+	}
+	if err = yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", filename, err)
+	}
+	return c, nil
+}
+
+func (c *config) validate() error {
+	if c.Namespace == "" {
+		return errors.New("namespace must not be empty")
+	}
+	if len(c.Targets) == 0 && len(c.Lookupd) == 0 {
+		return errors.New("neither targets nor nsqlookupd addresses given")
+	}
+	for _, t := range c.Targets {
+		if t.Address == "" {
+			return errors.New("target address must not be empty")
+		}
+	}
+	if c.PollInterval < 0 {
+		return errors.New("poll interval must not be negative")
+	}
+	if c.Timeout < 0 || c.TimeoutOffset < 0 || c.RetryBackoff < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	if c.OrphanedGracePeriod < 0 || c.StalledGracePeriod < 0 {
+		return errors.New("grace periods must not be negative")
+	}
+	if c.Canary.Interval < 0 {
+		return errors.New("canary interval must not be negative")
+	}
+	if c.Canary.Interval > 0 && (c.Canary.Timeout <= 0 || c.Canary.Topic == "" || c.Canary.Channel == "") {
+		return errors.New("canary requires a timeout, topic and channel")
+	}
+	if len(c.Collectors) == 0 {
+		return errors.New("no collectors given")
+	}
+
+	// building the collectors validates their names and options
+	_, lcs, err := c.collectors(c.Collectors)
+	if err != nil {
+		return err
+	}
+	if len(lcs) > 0 && len(c.Lookupd) == 0 {
+		return errors.New("lookupd collectors require nsqlookupd addresses")
+	}
+	return nil
+}
+
+// executor creates a new executor scraping the configured targets with
+// the configured collectors.
+func (c *config) executor() (*collector.NsqExecutor, error) {
+	targets := make([]collector.Target, len(c.Targets))
+	for i, t := range c.Targets {
+		nsqdURL, err := normalizeURL(t.Address, "/stats")
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = collector.Target{URL: nsqdURL, Timeout: t.Timeout}
+		if t.TLS != nil {
+			tls := t.TLS.collectorTLSConfig()
+			targets[i].TLS = &tls
+		}
+	}
+
+	var nodesURLs []string
+	for _, lookupdURL := range c.Lookupd {
+		nodesURL, err := normalizeURL(lookupdURL, "/nodes")
+		if err != nil {
+			return nil, err
+		}
+		nodesURLs = append(nodesURLs, nodesURL)
+	}
+
+	return c.newExecutor(targets, nodesURLs, c.Concurrency, c.Collectors)
+}
+
+// probeExecutor creates a new executor scraping the given nsqd node only.
+func (c *config) probeExecutor(target string, collectors []string) (*collector.NsqExecutor, error) {
+	nsqdURL, err := normalizeURL(target, "/stats")
+	if err != nil {
+		return nil, err
+	}
+	if len(collectors) == 0 {
+		collectors = c.Collectors
+	}
+	return c.newExecutor([]collector.Target{{URL: nsqdURL}}, nil, 1, collectors)
+}
+
+func (c *config) newExecutor(targets []collector.Target, lookupdURLs []string, concurrency int, collectors []string) (*collector.NsqExecutor, error) {
+	scs, lcs, err := c.collectors(collectors)
+	if err != nil {
+		return nil, err
+	}
+	ex, err := collector.NewNsqExecutor(c.Namespace, targets, lookupdURLs, concurrency, c.TLS.collectorTLSConfig())
+	if err != nil {
+		return nil, err
+	}
+	ex.SetTimeout(c.Timeout)
+	ex.SetRetries(c.Retries, c.RetryBackoff)
+	for _, sc := range scs {
+		ex.Use(sc)
+	}
+	for _, lc := range lcs {
+		ex.UseLookupd(lc)
+	}
+	return ex, nil
+}
+
+// collectors creates the stats and lookupd collectors with the given
+// names.
+func (c *config) collectors(names []string) ([]collector.StatsCollector, []collector.LookupdCollector, error) {
+	opts, err := c.collectorOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var scs []collector.StatsCollector
+	var lcs []collector.LookupdCollector
+	for _, param := range names {
+		param = strings.TrimSpace(param)
+		parts := strings.SplitN(param, ".", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid collector name: %s", param)
+		}
+
+		name := parts[1]
+		switch parts[0] {
+		case "stats":
+			sc, has := statsRegistry[name]
+			if !has {
+				return nil, nil, fmt.Errorf("unknown stats collector: %s", name)
+			}
+			scs = append(scs, sc(opts))
+		case "lookupd":
+			lc, has := lookupdRegistry[name]
+			if !has {
+				return nil, nil, fmt.Errorf("unknown lookupd collector: %s", name)
+			}
+			lcs = append(lcs, lc(opts))
+		default:
+			return nil, nil, fmt.Errorf("invalid collector prefix: %s", parts[0])
+		}
+	}
+	return scs, lcs, nil
+}
+
+func (c *config) collectorOptions() (collector.Options, error) {
+	opts := collector.Options{
+		Namespace:              c.Namespace,
+		LegacyCounters:         c.LegacyCounters,
+		PausedLabel:            c.LegacyPausedLabel,
+		SkipEphemeral:          c.Filters.SkipEphemeral,
+		ClientGroupLabels:      c.ClientGroupLabels,
+		AggregateProducerHosts: c.AggregateProducerHosts,
+		OrphanedGracePeriod:    c.OrphanedGracePeriod,
+		StalledGracePeriod:     c.StalledGracePeriod,
+	}
+
+	var err error
+	if opts.TopicFilter, err = c.Filters.Topics.filter(); err != nil {
+		return opts, err
+	}
+	if opts.ChannelFilter, err = c.Filters.Channels.filter(); err != nil {
+		return opts, err
+	}
+	if opts.ClientFilter, err = c.Filters.Clients.filter(); err != nil {
+		return opts, err
+	}
+	return opts, opts.Validate()
+}
+
+// filter compiles the regular expressions of the filter. The expressions
+// are anchored, so they have to match the whole name.
+func (c filterConfig) filter() (collector.Filter, error) {
+	var f collector.Filter
+	var err error
+	if c.Include != "" {
+		if f.Include, err = regexp.Compile("^(?:" + c.Include + ")$"); err != nil {
+			return f, fmt.Errorf("invalid include filter %q: %v", c.Include, err)
+		}
+	}
+	if c.Exclude != "" {
+		if f.Exclude, err = regexp.Compile("^(?:" + c.Exclude + ")$"); err != nil {
+			return f, fmt.Errorf("invalid exclude filter %q: %v", c.Exclude, err)
+		}
+	}
+	return f, nil
+}
+
+func (c canaryConfig) collectorCanaryConfig() collector.CanaryConfig {
+	return collector.CanaryConfig{
+		Interval: c.Interval,
+		Timeout:  c.Timeout,
+		Topic:    c.Topic,
+		Channel:  c.Channel,
+	}
+}
+
+func (c tlsConfig) collectorTLSConfig() collector.TLSConfig {
+	return collector.TLSConfig{
+		CACert:             c.CACert,
+		Cert:               c.Cert,
+		Key:                c.Key,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+}
+
+// splitList splits a comma-separated list and drops empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
@@ -1,48 +1,146 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/lovoo/nsq_exporter/collector"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Version of nsq_exporter. Set at build time.
-const Version = "0.0.0.dev"
+// Version and Revision of nsq_exporter. Set at build time.
+var (
+	Version  = "0.0.0.dev"
+	Revision = "unknown"
+)
+
+// defaultCanaryTopic is the default topic of the canary. It is ephemeral,
+// so nsqd deletes it when the canary disconnects.
+const defaultCanaryTopic = "nsq_exporter_canary#ephemeral"
+
+// defaultCanaryChannel is the default channel of the canary. nsqd
+// distributes the messages of a channel over its subscribers, so the
+// channel is unique per exporter process to keep exporters from consuming
+// the canary messages of each other.
+var defaultCanaryChannel = canaryChannelName()
 
 var (
+	configFile        = flag.String("config.file", "", "YAML configuration file. Overrides the nsqd, collector, filter and TLS flags.")
 	listenAddress     = flag.String("web.listen", ":9117", "Address on which to expose metrics and web interface.")
+	webConfigFile     = flag.String("web.config.file", "", "Web configuration file enabling TLS and basic auth, in the format of the Prometheus exporter toolkit.")
+	readyMaxAge       = flag.Duration("web.ready_max_age", 5*time.Minute, "Maximum age of the last successful nsqd scrape for the exporter to be reported ready.")
 	metricsPath       = flag.String("web.path", "/metrics", "Path under which to expose metrics.")
-	nsqdURL           = flag.String("nsqd.addr", "http://localhost:4151/stats", "Address of the nsqd node.")
+	probePath         = flag.String("web.probe_path", "/probe", "Path under which to expose metrics of a single nsqd node given by the target parameter.")
+	nsqdURL           = flag.String("nsqd.addr", "http://localhost:4151/stats", "Comma-separated list of nsqd node addresses.")
+	nsqdConcurrency   = flag.Int("nsqd.concurrency", 8, "Maximum number of nsqd nodes to scrape in parallel.")
+	nsqdTimeout       = flag.Duration("nsqd.timeout", 10*time.Second, "Timeout of requests to nsqd if Prometheus does not send its scrape timeout.")
+	timeoutOffset     = flag.Duration("nsqd.timeout_offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout sent by Prometheus.")
+	nsqdRetries       = flag.Int("nsqd.retries", 0, "Number of retries of failed nsqd requests.")
+	retryBackoff      = flag.Duration("nsqd.retry_backoff", 100*time.Millisecond, "Backoff before the first retry of a failed nsqd request, doubled on every retry.")
+	pollInterval      = flag.Duration("nsqd.poll_interval", 0, "Poll nsqd in the background in this interval and serve the last polled stats. Disabled if 0.")
 	enabledCollectors = flag.String("collect", "stats.topics,stats.channels", "Comma-separated list of collectors to use.")
 	namespace         = flag.String("namespace", "nsq", "Namespace for the NSQ metrics.")
 	tlsCACert         = flag.String("tls.ca_cert", "", "CA certificate file to be used for nsqd connections.")
 	tlsCert           = flag.String("tls.cert", "", "TLS certificate file to be used for client connections to nsqd.")
 	tlsKey            = flag.String("tls.key", "", "TLS key file to be used for TLS client connections to nsqd.")
+	tlsInsecure       = flag.Bool("tls.insecure_skip_verify", false, "Do not verify the TLS certificate of nsqd.")
+	tlsServerName     = flag.String("tls.server_name", "", "Name to verify the TLS certificate of nsqd against. Defaults to the host of the nsqd address.")
+	legacyCounters    = flag.Bool("legacy.counter_gauges", false, "Additionally export the nsqd message totals as gauges with their former *_count names.")
+	pausedLabel       = flag.Bool("legacy.paused_label", false, "Additionally label the topic and channel metrics with their pause state.")
+	topicInclude      = flag.String("filter.topic_include", "", "Regular expression of topic names to export.")
+	topicExclude      = flag.String("filter.topic_exclude", "", "Regular expression of topic names not to export.")
+	channelInclude    = flag.String("filter.channel_include", "", "Regular expression of channel names to export.")
+	channelExclude    = flag.String("filter.channel_exclude", "", "Regular expression of channel names not to export.")
+	clientInclude     = flag.String("filter.client_include", "", "Regular expression of client hostnames to export.")
+	clientExclude     = flag.String("filter.client_exclude", "", "Regular expression of client hostnames not to export.")
+	skipEphemeral     = flag.Bool("filter.skip_ephemeral", false, "Do not export ephemeral topics and channels.")
+	clientGroupLabels = flag.String("clients_by_host.labels", strings.Join(collector.DefaultClientGroupLabels, ","), "Comma-separated list of labels the clients are grouped by in the clients_by_host collector.")
+	aggregateHosts    = flag.Bool("producers.aggregate_hosts", false, "Sum up the producers of a topic over all hosts in the producers collector.")
+	orphanedGrace     = flag.Duration("channel.orphaned_grace_period", 0, "Duration a channel has to be orphaned before it is reported.")
+	stalledGrace      = flag.Duration("channel.stalled_grace_period", 0, "Duration a channel has to be stalled before it is reported.")
+	canaryInterval    = flag.Duration("canary.interval", 0, "Publish and consume a canary message on every nsqd node in this interval. Disabled if 0.")
+	canaryTimeout     = flag.Duration("canary.timeout", 5*time.Second, "Timeout of a canary round of a single nsqd node.")
+	canaryTopic       = flag.String("canary.topic", defaultCanaryTopic, "Topic the canary messages are published to.")
+	canaryChannel     = flag.String("canary.channel", defaultCanaryChannel, "Channel the canary messages are consumed from. Must not be shared by several exporters.")
+	lookupdURLs       stringsFlag
 
-	statsRegistry = map[string]func(namespace string) collector.StatsCollector{
-		"topics":   collector.TopicStats,
-		"channels": collector.ChannelStats,
-		"clients":  collector.ClientStats,
+	statsRegistry = map[string]func(opts collector.Options) collector.StatsCollector{
+		"topics":          collector.TopicStats,
+		"channels":        collector.ChannelStats,
+		"clients":         collector.ClientStats,
+		"clients_by_host": collector.ClientsByHostStats,
+		"memory":          collector.MemoryStats,
+		"node":            collector.NodeStats,
+		"producers":       collector.ProducerStats,
+		"backlog":         collector.BacklogStats,
+	}
+	lookupdRegistry = map[string]func(opts collector.Options) collector.LookupdCollector{
+		"nodes":  collector.LookupdNodeStats,
+		"topics": collector.LookupdTopicStats,
 	}
+
+	// The current configuration and executor, replaced on every reload.
+	mutex      sync.RWMutex
+	currentCfg *config
+	currentEx  *collector.NsqExecutor
+	// lastSuccess is the last successful scrape of the replaced executors
+	// and the probe executors, so the exporter stays ready across reloads
+	// and when it is only used through /probe.
+	lastSuccess time.Time
 )
 
+func init() {
+	flag.Var(&lookupdURLs, "nsqlookupd.addr", "Address of a nsqlookupd node to discover nsqd nodes from. May be repeated.")
+
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nsq_exporter",
+		Name:      "build_info",
+		Help:      "Version, revision and Go version nsq_exporter was built with, always 1",
+	}, []string{"version", "revision", "goversion"})
+	buildInfo.WithLabelValues(Version, Revision, runtime.Version()).Set(1)
+	prometheus.MustRegister(buildInfo)
+}
+
 func main() {
 	flag.Parse()
 
-	ex, err := createNsqExecutor()
+	c, err := readConfig()
 	if err != nil {
+		log.Fatal(err)
+	}
+	if err = applyConfig(c); err != nil {
 		log.Fatalf("error creating nsq executor: %v", err)
 	}
-	prometheus.MustRegister(ex)
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				log.Printf("error reloading configuration: %v", err)
+			}
+		}
+	}()
+
+	http.Handle(*metricsPath, prometheus.InstrumentHandlerFunc("prometheus", metricsHandler))
+	http.HandleFunc(*probePath, probeHandler)
+	http.HandleFunc("/-/reload", reloadHandler)
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/-/ready", readyHandler)
 	if *metricsPath != "" && *metricsPath != "/" {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`<html>
@@ -50,49 +148,177 @@ func main() {
 			<body>
 			<h1>NSQ Exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="` + *probePath + `?target=localhost:4151">Probe localhost:4151</a></p>
 			</body>
 			</html>`))
 		})
 	}
 
+	log.Printf("starting nsq_exporter %s (revision %s)", Version, Revision)
 	log.Print("listening to ", *listenAddress)
-	err = http.ListenAndServe(*listenAddress, nil)
+	err = listenAndServe(*listenAddress, http.DefaultServeMux, *webConfigFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func createNsqExecutor() (*collector.NsqExecutor, error) {
-	nsqdURL, err := normalizeURL(*nsqdURL)
-	if err != nil {
-		return nil, err
+// readConfig reads the configuration file if given, otherwise the
+// configuration is built from the command line flags.
+func readConfig() (*config, error) {
+	if *configFile != "" {
+		return loadConfig(*configFile)
 	}
+	c := configFromFlags()
+	return c, c.validate()
+}
 
-	ex, err := collector.NewNsqExecutor(*namespace, nsqdURL, *tlsCACert, *tlsCert, *tlsKey)
+// applyConfig replaces the current executor by a new one created from
+// the given configuration.
+func applyConfig(c *config) error {
+	ex, err := c.executor()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	for _, param := range strings.Split(*enabledCollectors, ",") {
-		param = strings.TrimSpace(param)
-		parts := strings.SplitN(param, ".", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid collector name: %s", param)
-		}
-		if parts[0] != "stats" {
-			return nil, fmt.Errorf("invalid collector prefix: %s", parts[0])
-		}
 
-		name := parts[1]
-		c, has := statsRegistry[name]
-		if !has {
-			return nil, fmt.Errorf("unknown stats collector: %s", name)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if currentEx != nil {
+		currentEx.Stop()
+		if last := currentEx.LastSuccess(); last.After(lastSuccess) {
+			lastSuccess = last
 		}
-		ex.Use(c(*namespace))
 	}
-	return ex, nil
+	if c.PollInterval > 0 {
+		ex.StartPolling(c.PollInterval)
+	}
+	if c.Canary.Interval > 0 {
+		ex.StartCanary(c.Canary.collectorCanaryConfig())
+	}
+	currentCfg, currentEx = c, ex
+	return nil
+}
+
+func reload() error {
+	if *configFile == "" {
+		return errors.New("no configuration file given")
+	}
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if err = applyConfig(c); err != nil {
+		return err
+	}
+	log.Print("reloaded configuration from ", *configFile)
+	return nil
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// healthyHandler reports that the exporter is running.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
 }
 
-func normalizeURL(ustr string) (string, error) {
+// readyHandler reports whether a nsqd node has been scraped successfully
+// within the maximum age. It does not query nsqd itself.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	ex, last := currentEx, lastSuccess
+	mutex.RUnlock()
+
+	if l := ex.LastSuccess(); l.After(last) {
+		last = l
+	}
+	if last.IsZero() {
+		http.Error(w, "no nsqd node scraped successfully yet", http.StatusServiceUnavailable)
+		return
+	}
+	if age := time.Since(last); age > *readyMaxAge {
+		http.Error(w, "last successful nsqd scrape "+age.Truncate(time.Second).String()+" ago", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// metricsHandler exposes the metrics of the configured nsqd nodes along
+// with the metrics of the exporter process.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	c, ex := currentCfg, currentEx
+	mutex.RUnlock()
+
+	ctx, cancel := scrapeContext(r, c.TimeoutOffset)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ex.WithContext(ctx))
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeContext returns the context of the scrape request. The context
+// expires offset before the scrape timeout sent by Prometheus.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	ctx := r.Context()
+	secs, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil {
+		return context.WithCancel(ctx)
+	}
+
+	timeout := time.Duration(secs*float64(time.Second)) - offset
+	if timeout <= 0 {
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// probeHandler exposes the metrics of the nsqd node given by the target
+// parameter. The collectors can be chosen by the collect parameter and
+// default to the configured ones.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	mutex.RLock()
+	c := currentCfg
+	mutex.RUnlock()
+
+	ex, err := c.probeExecutor(target, splitList(params.Get("collect")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := scrapeContext(r, c.TimeoutOffset)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ex.WithContext(ctx))
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+
+	mutex.Lock()
+	if last := ex.LastSuccess(); last.After(lastSuccess) {
+		lastSuccess = last
+	}
+	mutex.Unlock()
+}
+
+func normalizeURL(ustr, path string) (string, error) {
 	ustr = strings.ToLower(ustr)
 	if !strings.HasPrefix(ustr, "https://") && !strings.HasPrefix(ustr, "http://") {
 		ustr = "http://" + ustr
@@ -103,8 +329,50 @@ func normalizeURL(ustr string) (string, error) {
 		return "", err
 	}
 	if u.Path == "" {
-		u.Path = "/stats"
+		u.Path = path
 	}
 	u.RawQuery = "format=json"
 	return u.String(), nil
 }
+
+// canaryChannelName returns an ephemeral channel name containing the
+// hostname and process ID, shortened to the maximum length of nsq names.
+func canaryChannelName() string {
+	hostname, _ := os.Hostname()
+	hostname = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, hostname)
+
+	prefix := "nsq_exporter_canary_" + hostname
+	suffix := "_" + strconv.Itoa(os.Getpid()) + "#ephemeral"
+	if max := 64 - len(suffix); len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return prefix + suffix
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// stringsFlag is a flag which can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
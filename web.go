@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig configures how the exporter serves its endpoints. The format
+// is compatible with the web configuration of the Prometheus exporter
+// toolkit, see https://github.com/prometheus/exporter-toolkit.
+type webConfig struct {
+	TLS   webTLSConfig      `yaml:"tls_server_config"`
+	HTTP  webHTTPConfig     `yaml:"http_server_config"`
+	Users map[string]string `yaml:"basic_auth_users"`
+}
+
+type webTLSConfig struct {
+	CertFile     string     `yaml:"cert_file"`
+	KeyFile      string     `yaml:"key_file"`
+	ClientAuth   string     `yaml:"client_auth_type"`
+	ClientCAFile string     `yaml:"client_ca_file"`
+	MinVersion   tlsVersion `yaml:"min_version"`
+	MaxVersion   tlsVersion `yaml:"max_version"`
+
+	CipherSuites             []cipherSuite `yaml:"cipher_suites"`
+	CurvePreferences         []curveID     `yaml:"curve_preferences"`
+	PreferServerCipherSuites bool          `yaml:"prefer_server_cipher_suites"`
+	ClientAllowedSANs        []string      `yaml:"client_allowed_sans"`
+}
+
+type webHTTPConfig struct {
+	// HTTP2 is only read on startup.
+	HTTP2   bool              `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+type tlsVersion uint16
+
+var tlsVersions = map[string]tlsVersion{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+func (v *tlsVersion) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	version, has := tlsVersions[s]
+	if !has {
+		return fmt.Errorf("unknown TLS version: %s", s)
+	}
+	*v = version
+	return nil
+}
+
+type cipherSuite uint16
+
+func (cs *cipherSuite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == s {
+				*cs = cipherSuite(suite.ID)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unknown cipher suite: %s", s)
+}
+
+type curveID tls.CurveID
+
+var curveIDs = map[string]curveID{
+	"CurveP256": curveID(tls.CurveP256),
+	"CurveP384": curveID(tls.CurveP384),
+	"CurveP521": curveID(tls.CurveP521),
+	"X25519":    curveID(tls.X25519),
+}
+
+func (c *curveID) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	id, has := curveIDs[s]
+	if !has {
+		return fmt.Errorf("unknown curve: %s", s)
+	}
+	*c = id
+	return nil
+}
+
+// loadWebConfig reads the web configuration from the given YAML file.
+func loadWebConfig(filename string) (*webConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &webConfig{
+		TLS:  webTLSConfig{MinVersion: tls.VersionTLS12},
+		HTTP: webHTTPConfig{HTTP2: true},
+	}
+	if err = yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid web configuration %s: %v", filename, err)
+	}
+	return c, nil
+}
+
+func (c *webConfig) validate() error {
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("cert_file and key_file must be given together")
+	}
+	if _, has := clientAuthTypes[c.TLS.ClientAuth]; !has {
+		return fmt.Errorf("unknown client_auth_type: %s", c.TLS.ClientAuth)
+	}
+	if c.TLS.CertFile == "" && (c.TLS.ClientCAFile != "" || c.TLS.ClientAuth != "") {
+		return errors.New("client authentication requires cert_file and key_file")
+	}
+	if c.TLS.MaxVersion != 0 && c.TLS.MaxVersion < c.TLS.MinVersion {
+		return errors.New("max_version must not be lower than min_version")
+	}
+	if len(c.TLS.ClientAllowedSANs) > 0 && c.TLS.ClientCAFile == "" {
+		return errors.New("client_allowed_sans requires client_ca_file")
+	}
+	return nil
+}
+
+// tlsConfig loads the certificates of the TLS configuration. It returns
+// nil if TLS is not configured.
+func (c *webConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLS.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		ClientAuth:               clientAuthTypes[c.TLS.ClientAuth],
+		MinVersion:               uint16(c.TLS.MinVersion),
+		MaxVersion:               uint16(c.TLS.MaxVersion),
+		PreferServerCipherSuites: c.TLS.PreferServerCipherSuites,
+	}
+	for _, cs := range c.TLS.CipherSuites {
+		cfg.CipherSuites = append(cfg.CipherSuites, uint16(cs))
+	}
+	for _, id := range c.TLS.CurvePreferences {
+		cfg.CurvePreferences = append(cfg.CurvePreferences, tls.CurveID(id))
+	}
+	if len(c.TLS.ClientAllowedSANs) > 0 {
+		cfg.VerifyPeerCertificate = c.verifyClientSANs
+	}
+	if c.TLS.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLS.ClientCAFile)
+		}
+	}
+	return cfg, nil
+}
+
+// verifyClientSANs checks that the verified client certificate contains
+// one of the allowed subject alternative names.
+func (c *webConfig) verifyClientSANs(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return errors.New("no verified client certificate")
+	}
+	cert := chains[0][0]
+	sans := append(append([]string(nil), cert.DNSNames...), cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, san := range sans {
+		for _, allowed := range c.TLS.ClientAllowedSANs {
+			if san == allowed {
+				return nil
+			}
+		}
+	}
+	return errors.New("client certificate contains no allowed subject alternative name")
+}
+
+// listenAndServe serves the handler on the given address. If a web
+// configuration file is given, the handler is served over TLS and
+// protected by basic auth as configured. The file is read again for every
+// TLS handshake and request, so changed certificates and users take effect
+// without restarting.
+func listenAndServe(addr string, handler http.Handler, webConfigFile string) error {
+	if webConfigFile == "" {
+		return http.ListenAndServe(addr, handler)
+	}
+
+	c, err := loadWebConfig(webConfigFile)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: &authHandler{handler: handler, webConfigFile: webConfigFile},
+	}
+	if c.TLS.CertFile == "" {
+		return server.ListenAndServe()
+	}
+
+	// check the certificates before listening
+	if _, err = c.tlsConfig(); err != nil {
+		return err
+	}
+	nextProtos := []string{"h2", "http/1.1"}
+	if !c.HTTP.HTTP2 {
+		nextProtos = []string{"http/1.1"}
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	server.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := loadWebConfig(webConfigFile)
+			if err != nil {
+				return nil, err
+			}
+			cfg, err := c.tlsConfig()
+			if err != nil {
+				return nil, err
+			}
+			cfg.NextProtos = nextProtos
+			return cfg, nil
+		},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// dummyHash is compared for unknown users.
+var dummyHash = []byte("$2a$10$fuSJaLLd9tX0syWEnj5iTu9jYs8Wj.oD2LbvASv4oGe3AGPQX231G")
+
+// authHandler requires basic auth for all requests, if users are
+// configured in the web configuration.
+type authHandler struct {
+	handler       http.Handler
+	webConfigFile string
+
+	// cache holds the hashes of successfully authenticated credentials,
+	// as checking bcrypt hashes is expensive by design.
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]bool
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := loadWebConfig(h.webConfigFile)
+	if err != nil {
+		http.Error(w, "invalid web configuration", http.StatusInternalServerError)
+		return
+	}
+	for name, value := range c.HTTP.Headers {
+		w.Header().Set(name, value)
+	}
+	if len(c.Users) > 0 && !h.authenticated(c, r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nsq_exporter"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *authHandler) authenticated(c *webConfig, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, has := c.Users[user]
+	if !has {
+		// compare anyway, so unknown users cannot be told apart by timing
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	h.mutex.Lock()
+	cached := h.cache[key]
+	h.mutex.Unlock()
+	if cached {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	h.mutex.Lock()
+	if h.cache == nil {
+		h.cache = make(map[[sha256.Size]byte]bool)
+	}
+	h.cache[key] = true
+	h.mutex.Unlock()
+	return true
+}